@@ -1,84 +1,955 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
+	"github.com/dubo-dubon-duponey/wizhard/config"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"github.com/dubo-dubon-duponey/wizhard/discovery"
 	"github.com/dubo-dubon-duponey/wizhard/homekit"
+	"github.com/dubo-dubon-duponey/wizhard/simulator"
 	"github.com/dubo-dubon-duponey/wizhard/utils"
 	"github.com/urfave/cli"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
-var bulb *homekit.WizLightbulb
-
 func register(c *cli.Context) error {
-	ips := c.StringSlice("ips")
-	pin := c.String("pin")
-	storage := c.String("data-path")
-	port := c.String("port")
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
 
 	info := accessory.Info{
-		Name:             c.String("name"),
-		Manufacturer:     c.String("manufacturer"),
-		SerialNumber:     c.String("serial"),
-		Model:            c.String("model"),
-		FirmwareRevision: c.String("version"),
+		Name:             cfg.Bridge.Name,
+		Manufacturer:     cfg.Bridge.Manufacturer,
+		SerialNumber:     cfg.Bridge.Serial,
+		Model:            cfg.Bridge.Model,
+		FirmwareRevision: cfg.Bridge.Version,
+	}
+
+	if len(cfg.Bulbs) == 0 && !c.Bool("discover") {
+		fmt.Println("Hey! You need to provide at least one ip (or use --discover)! These bulbs are not going to get to work on themselves!")
+	}
+
+	mixings, err := parseMixings(c.StringSlice("mixing"))
+	if err != nil {
+		return err
 	}
 
-	if len(ips) == 0 {
-		fmt.Println("Hey! You need to provide at least one ip! These bulbs are not going to get to work on themselves!")
+	bridge := homekit.NewBridge(info, hc.Config{
+		Pin:         cfg.Bridge.Pin,
+		StoragePath: cfg.Bridge.DataPath,
+		Port:        cfg.Bridge.Port,
+	})
+
+	registry, err := homekit.LoadRegistry(cfg.Bridge.DataPath)
+	if err != nil {
+		return err
 	}
 
-	//  ip := fmt.Sprintf("%s:38899", ips[0])
-	//  bulb := homekit.NewWizLightbulb(ip, info)
+	// Cancelled on termination, so that we do not hang on bulbs that do not answer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Bulbs exposed on the bridge, by bridge key
+	running := map[string]*exposed{}
+	mutex := sync.Mutex{}
+	// Serializes changes to the set of bulbs (startup, discovery, reloads)
+	changes := sync.Mutex{}
 
-	bulbs := []*accessory.Accessory{}
+	// A single socket for all bulbs - bound to the port bulbs push to, if we want them to
+	bind := ""
+	if c.BoolT("push") {
+		bind = fmt.Sprintf(":%d", controller.LISTENER_PORT)
+	}
+	transport, err := utils.NewUDPTransport(bind)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
 
-	for x, ip := range ips {
-		fmt.Println("Addr:", ip)
-		ip = fmt.Sprintf("%s:38899", ip)
-		u, _ := utils.GenerateUUID()
-		n := fmt.Sprintf("Wiz %d", x)
-		fmt.Println("Bulb info", n, ip)
-		bulb = homekit.NewWizLightbulb(ip, accessory.Info{
-			Name:             n,
+	// Have bulbs push their state to us, so that changes made outside of HomeKit show up right away
+	var listener *controller.Listener
+	if c.BoolT("push") {
+		listener = controller.NewListener(c.String("push-ip"), transport)
+		err = listener.Start()
+		if err != nil {
+			return err
+		}
+		defer listener.Stop()
+	}
+
+	// Configured bulbs, by mac, so that discovered bulbs get their configuration
+	configured := map[string]config.Bulb{}
+	for _, b := range cfg.Bulbs {
+		if b.Mac != "" {
+			configured[b.Mac] = b
+		}
+	}
+
+	// Expose a bulb, keyed by mac if it answered so that discovery does not add it a second time
+	// source is the configuration key of the bulb (see bulbKey), empty for bulbs that are not configured
+	// found is the address discovery found the bulb at, if it did
+	addBulb := func(b config.Bulb, source string, found string) bool {
+		// As configured, so that reloads can tell whether the configuration changed
+		configured := b
+		if b.Address == "" {
+			b.Address = found
+		}
+		// Bulbs configured by mac only have to be found first
+		if b.Address == "" {
+			found, err := discovery.Find(c.String("broadcast"), b.Mac, c.Duration("discover-window"))
+			if err != nil {
+				fmt.Println("Alas, we could not find thy noble lightbulb", b.Mac, err)
+				return false
+			}
+			b.Address = found.IP
+		}
+
+		timeout := cfg.Timeout
+		if b.Timeout != 0 {
+			timeout = b.Timeout
+		}
+		retries := cfg.Retries
+		if b.Retries != 0 {
+			retries = b.Retries
+		}
+
+		address := bulbAddress(b.Address)
+		wiz := controller.NewWizController(transport, address)
+		wiz.Timeout = timeout
+		wiz.Retries = retries
+		wiz.Backoff = c.Duration("backoff")
+		wiz.Model = b.Model
+		// Follow the bulb if the router hands it a new lease
+		wiz.Locate = func(mac string) (string, error) {
+			b, err := discovery.Find(c.String("broadcast"), mac, c.Duration("discover-window"))
+			if err != nil {
+				return "", err
+			}
+			if _, err = registry.Identity(mac, b.Address()); err != nil {
+				fmt.Println("Failed persisting bulb identity", err)
+			}
+			return b.Address(), nil
+		}
+		// Only now that it is configured, get the current state in
+		err := wiz.Init(ctx)
+		if err != nil {
+			fmt.Println("Alas, thy noble lightbulb at", address, "did not answer yet:", err)
+		}
+		firmware := wiz.Firmware()
+		if b.Mac != "" && firmware.Mac != "" && b.Mac != firmware.Mac {
+			fmt.Println("Bulb at", address, "is", firmware.Mac, "and not", b.Mac, "as configured")
+		}
+		key := firmware.Mac
+		if key == "" {
+			key = b.Address
+		}
+		if bridge.Has(key) {
+			wiz.Stop()
+			return false
+		}
+
+		identity, err := registry.Identity(firmware.Mac, address)
+		if err != nil {
+			fmt.Println("Failed persisting bulb identity", err)
+		}
+		name := identity.Name
+		if b.DisplayName() != "" {
+			name = b.DisplayName()
+		}
+
+		names := cfg.Scenes
+		if b.Scenes != nil {
+			names = b.Scenes
+		}
+		scenes, err := parseScenes(names)
+		if err != nil {
+			fmt.Println("Ignoring scenes for bulb", address, err)
+		}
+
+		fmt.Println("Bulb info", name, address, firmware.Mac)
+		bulbInfo := accessory.Info{
+			Name:             name,
 			Manufacturer:     info.Manufacturer,
-			SerialNumber:     u,
-			Model:            "Bulby",
-			FirmwareRevision: info.FirmwareRevision,
-		})
-		bulbs = append(bulbs, bulb.Accessory)
+			SerialNumber:     identity.SerialNumber,
+			Model:            firmware.ModuleName,
+			FirmwareRevision: firmware.FwVersion,
+			ID:               identity.ID,
+		}
+		if b.Model != "" {
+			bulbInfo.Model = b.Model
+		}
+		// Plugs speak the same protocol, but are not lights
+		// Built again whenever the bridge restarts - the last one built is the one the controller reports to
+		build := func() *accessory.Accessory {
+			if wiz.Capabilities().Outlet {
+				return homekit.NewWizOutlet(wiz, bulbInfo).Accessory
+			}
+			return homekit.NewWizLightbulb(wiz, bulbInfo, scenes...).Accessory
+		}
+		// HomeKit is served from the cached state, kept fresh in the background
+		wiz.PollInterval = cfg.PollInterval
+		wiz.MaxStaleness = cfg.MaxStaleness
+		wiz.Debounce = cfg.Debounce
+		if b.Mixing != "" {
+			wiz.Mixing, _ = controller.MixingByName(b.Mixing)
+		} else if m, ok := mixings[bulbInfo.Model]; ok {
+			wiz.Mixing = m
+		} else {
+			wiz.Mixing = mixings[""]
+		}
+		wiz.Poll()
+		if listener != nil {
+			listener.Add(wiz)
+		}
+		mutex.Lock()
+		running[key] = &exposed{wiz: wiz, source: source, bulb: configured}
+		mutex.Unlock()
+		return bridge.Add(key, build)
+	}
+
+	// Take a bulb off the bridge
+	removeBulb := func(key string) {
+		mutex.Lock()
+		e, ok := running[key]
+		delete(running, key)
+		mutex.Unlock()
+		if !ok {
+			return
+		}
+		fmt.Println("Removing bulb", key)
+		bridge.Remove(key)
+		if listener != nil {
+			listener.Remove(e.wiz)
+		}
+		e.wiz.Stop()
+	}
+
+	// Expose a bulb that is not configured, found at address
+	addDiscovered := func(mac string, address string) bool {
+		fmt.Println("Discovered new bulb", mac, address)
+		return addBulb(config.Bulb{Mac: mac}, "", address)
+	}
+
+	for _, b := range cfg.Bulbs {
+		fmt.Println("Addr:", b.Address, b.Mac)
+		addBulb(b, bulbKey(b), "")
+	}
+
+	// Apply a new configuration: bulbs that are gone or changed are removed, new ones are added, the others keep running
+	reload := func() {
+		changes.Lock()
+		defer changes.Unlock()
+
+		next, err := loadConfig(c)
+		if err != nil {
+			fmt.Println("Alas, the new configuration is not valid - keeping the current one", err)
+			return
+		}
+		if next.Bridge != cfg.Bridge {
+			fmt.Println("Bridge settings changed - they will only apply after a restart")
+		}
+		// Defaults apply to all bulbs - if they changed, every bulb has
+		defaults := func(c config.Config) config.Config {
+			c.Bridge = config.Bridge{}
+			c.Bulbs = nil
+			return c
+		}
+		same := reflect.DeepEqual(defaults(*cfg), defaults(*next))
+
+		wanted := map[string]config.Bulb{}
+		for _, b := range next.Bulbs {
+			wanted[bulbKey(b)] = b
+		}
+
+		mutex.Lock()
+		stale := []string{}
+		current := map[string]bool{}
+		// Discovered bulbs to add again with the new defaults, by mac
+		rediscovered := map[string]string{}
+		for key, e := range running {
+			if e.source == "" {
+				// Discovered bulbs stay, unless they are now configured, or the defaults changed
+				if _, ok := wanted[key]; ok {
+					stale = append(stale, key)
+				} else if !same {
+					stale = append(stale, key)
+					rediscovered[key] = e.wiz.Addr()
+				}
+				continue
+			}
+			if b, ok := wanted[e.source]; !ok || !same || !reflect.DeepEqual(b, e.bulb) {
+				stale = append(stale, key)
+				continue
+			}
+			current[e.source] = true
+		}
+		mutex.Unlock()
+
+		changed := false
+		for _, key := range stale {
+			removeBulb(key)
+			changed = true
+		}
+
+		cfg = next
+		configured = map[string]config.Bulb{}
+		for _, b := range cfg.Bulbs {
+			if b.Mac != "" {
+				configured[b.Mac] = b
+			}
+		}
+		for _, b := range cfg.Bulbs {
+			if current[bulbKey(b)] {
+				continue
+			}
+			fmt.Println("Adding bulb", b.Address, b.Mac)
+			changed = addBulb(b, bulbKey(b), "") || changed
+		}
+		for mac, address := range rediscovered {
+			changed = addDiscovered(mac, address) || changed
+		}
+
+		if changed {
+			bridge.Refresh()
+		}
+	}
+
+	// Reload on SIGHUP, and whenever the configuration file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			fmt.Println("Reloading configuration")
+			reload()
+		}
+	}()
+	if path := c.String("config"); path != "" {
+		go watch(ctx, path, c.Duration("config-watch"), reload)
 	}
 
-	bridge := accessory.NewBridge(info)
+	if c.Bool("discover") {
+		discoverBulbs := func() bool {
+			changes.Lock()
+			defer changes.Unlock()
 
-	t, err := hc.NewIPTransport(hc.Config{
-		Pin:         pin,
-		StoragePath: storage,
-		Port:        port,
-	}, bridge.Accessory, bulbs...) // bulb.Accessory)
+			found, err := discovery.Discover(c.String("broadcast"), c.Duration("discover-window"))
+			if err != nil {
+				fmt.Println("Discovery failed", err)
+				return false
+			}
+			added := false
+			for _, b := range found {
+				if bridge.Has(b.Mac) {
+					continue
+				}
+				// Configured by address, and exposed under it as it did not answer then - expose it under its mac now
+				mutex.Lock()
+				key := ""
+				var silent *exposed
+				for k, e := range running {
+					host, _, _ := net.SplitHostPort(e.wiz.Addr())
+					if host == b.IP && (e.wiz.Mac() == "" || e.wiz.Mac() == b.Mac) {
+						key, silent = k, e
+						break
+					}
+				}
+				mutex.Unlock()
+				if silent != nil {
+					fmt.Println("Bulb at", key, "finally answered, it is", b.Mac)
+					removeBulb(key)
+					addBulb(silent.bulb, silent.source, "")
+					added = true
+					continue
+				}
+				bulb, ok := configured[b.Mac]
+				if !ok {
+					added = addDiscovered(b.Mac, b.IP) || added
+					continue
+				}
+				fmt.Println("Discovered configured bulb", b.Mac, b.IP)
+				added = addBulb(bulb, bulbKey(bulb), b.IP) || added
+			}
+			return added
+		}
 
-	/*  t, err := hc.NewIPTransport(hc.Config{
-	      Pin:         pin,
-	      StoragePath: storage,
-	      Port:        port,
-	    }, bridge.Accessory, bulbs...) // bulb.Accessory)
-	*/
+		// Find what we can before exposing the bridge, then keep looking for newcomers
+		discoverBulbs()
+		go func() {
+			for range time.Tick(c.Duration("discover-interval")) {
+				if discoverBulbs() {
+					bridge.Refresh()
+				}
+			}
+		}()
+	}
+
+	// Closed once the termination handler is done - returning earlier would close the transport under its feet
+	terminated := make(chan struct{})
+	hc.OnTermination(func() {
+		defer close(terminated)
+		cancel()
+		// No more bulbs coming in
+		changes.Lock()
+		defer changes.Unlock()
+		// Write whatever HomeKit changes are still pending, while the transport is still open
+		mutex.Lock()
+		for _, e := range running {
+			e.wiz.Stop()
+		}
+		mutex.Unlock()
+		bridge.Stop()
+	})
+
+	err = bridge.Run()
 	if err != nil {
 		return err
 	}
+	<-terminated
+	return nil
+}
 
-	hc.OnTermination(func() {
-		<-t.Stop()
+// A bulb exposed on the bridge
+type exposed struct {
+	wiz *controller.WizController
+	// Configuration key of the bulb (see bulbKey) - empty for bulbs that are not configured
+	source string
+	// Configuration the bulb was added with
+	bulb config.Bulb
+}
+
+// Key identifying a bulb in the configuration - its mac if it was configured by mac, its address otherwise
+func bulbKey(b config.Bulb) string {
+	if b.Mac != "" {
+		return b.Mac
+	}
+	return b.Address
+}
+
+// Call reload whenever the file at path changes (checking every interval), until ctx is done
+func watch(ctx context.Context, path string, interval time.Duration, reload func()) {
+	if interval <= 0 {
+		return
+	}
+	modified := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Editors may briefly remove the file while saving it - wait for it to come back
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	last := modified()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m := modified()
+			if m.IsZero() || m.Equal(last) {
+				continue
+			}
+			last = m
+			fmt.Println("Configuration file changed, reloading")
+			reload()
+		}
+	}
+}
+
+// Scenes to expose as switches, from their names
+func parseScenes(names []string) (scenes []controller.Scene, err error) {
+	for _, name := range names {
+		s, err := controller.SceneByName(name)
+		if err != nil {
+			return nil, err
+		}
+		scenes = append(scenes, s)
+	}
+	return scenes, nil
+}
+
+// Split scene names, either for all bulbs ("Fireplace,Cozy"), or for a specific one ("1.2.3.4=Fireplace,Cozy")
+func splitScenes(values []string) (names []string, bulbNames map[string][]string) {
+	bulbNames = map[string][]string{}
+	for _, value := range values {
+		ip := ""
+		if i := strings.Index(value, "="); i != -1 {
+			ip = value[:i]
+			value = value[i+1:]
+		}
+		list := []string{}
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == "" {
+				continue
+			}
+			list = append(list, strings.TrimSpace(name))
+		}
+		if ip == "" {
+			names = append(names, list...)
+		} else {
+			bulbNames[ip] = append(bulbNames[ip], list...)
+		}
+	}
+	return names, bulbNames
+}
+
+// Split ips given as a list, possibly of space separated ips (IPS="1.2.3.4 5.6.7.8")
+func splitIPs(values []string) (ips []string) {
+	for _, value := range values {
+		ips = append(ips, strings.Fields(value)...)
+	}
+	return ips
+}
+
+// Load the configuration file if there is one, with flags (and their env vars) overriding it, and flag defaults filling the blanks
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	cfg := &config.Config{}
+	if path := c.String("config"); path != "" {
+		var err error
+		cfg, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	str := func(target *string, flag string) {
+		if c.IsSet(flag) || *target == "" {
+			*target = c.String(flag)
+		}
+	}
+	str(&cfg.Bridge.Name, "name")
+	str(&cfg.Bridge.Pin, "pin")
+	str(&cfg.Bridge.Port, "port")
+	str(&cfg.Bridge.DataPath, "data-path")
+	str(&cfg.Bridge.Manufacturer, "manufacturer")
+	str(&cfg.Bridge.Serial, "serial")
+	str(&cfg.Bridge.Model, "model")
+	str(&cfg.Bridge.Version, "version")
+
+	duration := func(target *time.Duration, flag string) {
+		if c.IsSet(flag) || *target == 0 {
+			*target = c.Duration(flag)
+		}
+	}
+	duration(&cfg.Timeout, "timeout")
+	duration(&cfg.PollInterval, "poll-interval")
+	duration(&cfg.MaxStaleness, "max-staleness")
+	duration(&cfg.Debounce, "debounce")
+	if c.IsSet("retries") || cfg.Retries == 0 {
+		cfg.Retries = c.Int("retries")
+	}
+
+	// Scenes for all bulbs replace the file ones, scenes for a given ip replace that bulb ones
+	// SCENES is read here rather than by cli, which would split "1.2.3.4=Fireplace,Cozy" on the comma
+	scenes := c.StringSlice("scenes")
+	if !c.IsSet("scenes") {
+		scenes = strings.Fields(os.Getenv("SCENES"))
+	}
+	names, bulbNames := splitScenes(scenes)
+	if len(names) > 0 {
+		cfg.Scenes = names
+	}
+	for _, ip := range splitIPs(c.StringSlice("ips")) {
+		known := false
+		for _, b := range cfg.Bulbs {
+			known = known || b.Address == ip
+		}
+		if !known {
+			cfg.Bulbs = append(cfg.Bulbs, config.Bulb{Address: ip})
+		}
+	}
+	for i, b := range cfg.Bulbs {
+		if list, ok := bulbNames[b.Address]; ok {
+			cfg.Bulbs[i].Scenes = list
+		}
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// Parse color mixing strategies, either for all bulbs ("rgbcw"), or for a specific model ("ESP01_SHRGB1C_31=rgbw")
+func parseMixings(values []string) (map[string]controller.Mixing, error) {
+	mixings := map[string]controller.Mixing{}
+	for _, value := range values {
+		model := ""
+		if i := strings.Index(value, "="); i != -1 {
+			model = value[:i]
+			value = value[i+1:]
+		}
+		m, err := controller.MixingByName(value)
+		if err != nil {
+			return nil, err
+		}
+		mixings[model] = m
+	}
+	return mixings, nil
+}
+
+func scene(c *cli.Context) error {
+	if c.Bool("list") {
+		for _, s := range controller.Scenes() {
+			fmt.Printf("%2d %s\n", s, s)
+		}
+		return nil
+	}
+
+	ip := c.String("ip")
+	if ip == "" {
+		return errors.New("you need to provide the ip of the bulb to play the scene on")
+	}
+
+	name := c.Args().First()
+	if name == "" {
+		return errors.New("you need to provide the name of the scene to play (see --list)")
+	}
+
+	s, err := controller.SceneByName(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+
+	transport, err := utils.NewUDPTransport("")
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+
+	wiz := controller.NewWizController(transport, bulbAddress(ip))
+	defer wiz.Stop()
+	wiz.Timeout = c.Duration("timeout")
+	err = wiz.Init(ctx)
+	if err != nil {
+		return err
+	}
+	return wiz.SetScene(ctx, s, c.Uint("speed"))
+}
+
+// Connect to the bulb at --ip, failing if it does not answer
+func connect(ctx context.Context, c *cli.Context) (*controller.WizController, io.Closer, error) {
+	ip := c.String("ip")
+	if ip == "" {
+		return nil, nil, errors.New("you need to provide the ip of the bulb (--ip)")
+	}
+
+	transport, err := utils.NewUDPTransport("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wiz := controller.NewWizController(transport, bulbAddress(ip))
+	wiz.Timeout = c.Duration("timeout")
+	err = wiz.Init(ctx)
+	if err != nil {
+		wiz.Stop()
+		transport.Close()
+		return nil, nil, err
+	}
+	return wiz, transport, nil
+}
+
+func get(c *cli.Context) error {
+	out := results()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+
+	wiz, transport, err := connect(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	defer wiz.Stop()
+
+	state := wiz.Snapshot()
+	system := wiz.Firmware()
+
+	if c.Bool("json") {
+		j, err := json.MarshalIndent(struct {
+			State  controller.State    `json:"state"`
+			System controller.Firmware `json:"system"`
+		}{state, system}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(j))
+		return nil
+	}
+
+	power := "off"
+	if state.On {
+		power = "on"
+	}
+	mode := fmt.Sprintf("color r=%d g=%d b=%d c=%d w=%d", state.R, state.G, state.B, state.C, state.W)
+	if state.SceneId != 0 {
+		mode = fmt.Sprintf("scene %s (speed %d%%)", controller.Scene(state.SceneId), state.Speed)
+	} else if state.Temp != 0 {
+		mode = fmt.Sprintf("white %dK", state.Temp)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "MAC\t%s\n", system.Mac)
+	fmt.Fprintf(w, "MODULE\t%s\n", system.ModuleName)
+	fmt.Fprintf(w, "FIRMWARE\t%s\n", system.FwVersion)
+	fmt.Fprintf(w, "SIGNAL\t%d dBm\n", state.Rssi)
+	fmt.Fprintf(w, "POWER\t%s\n", power)
+	fmt.Fprintf(w, "BRIGHTNESS\t%d%%\n", state.Dimming)
+	fmt.Fprintf(w, "MODE\t%s\n", mode)
+	return w.Flush()
+}
+
+func set(c *cli.Context) error {
+	// Nothing to print on success, diagnostics go to stderr all the same
+	results()
+	if c.Bool("on") && c.Bool("off") {
+		return errors.New("make up your mind: --on or --off")
+	}
+	modes := 0
+	for _, flag := range []string{"rgb", "hex", "kelvin", "scene"} {
+		if c.IsSet(flag) {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return errors.New("only one of --rgb, --hex, --kelvin and --scene can be used at once")
+	}
+
+	// Validate everything before talking to the bulb
+	change := []func(state *controller.State){}
+	if c.Bool("on") || c.Bool("off") {
+		on := c.Bool("on")
+		change = append(change, func(state *controller.State) {
+			state.On = on
+		})
+	}
+	if c.IsSet("brightness") {
+		brightness := c.Uint("brightness")
+		if brightness < 10 || brightness > 100 {
+			return fmt.Errorf("brightness must be between 10 and 100 (got %d)", brightness)
+		}
+		change = append(change, func(state *controller.State) {
+			state.Dimming = brightness
+		})
+	}
+	if c.IsSet("rgb") || c.IsSet("hex") {
+		var r, g, b uint
+		var err error
+		if c.IsSet("rgb") {
+			r, g, b, err = parseRGB(c.String("rgb"))
+		} else {
+			r, g, b, err = parseHex(c.String("hex"))
+		}
+		if err != nil {
+			return err
+		}
+		change = append(change, func(state *controller.State) {
+			state.SceneId = 0
+			state.Temp = 0
+			state.R, state.G, state.B, state.C, state.W = r, g, b, 0, 0
+		})
+	}
+	// Range depends on the bulb, checked once we know what it is
+	kelvin := c.Uint("kelvin")
+	if c.IsSet("kelvin") {
+		change = append(change, func(state *controller.State) {
+			state.SceneId = 0
+			state.Temp = kelvin
+		})
+	}
+	if c.IsSet("scene") || c.IsSet("speed") {
+		speed := c.Uint("speed")
+		if c.IsSet("speed") && (speed < controller.SPEED_MIN || speed > controller.SPEED_MAX) {
+			return fmt.Errorf("speed must be between %d and %d (got %d)", controller.SPEED_MIN, controller.SPEED_MAX, speed)
+		}
+		var scene controller.Scene
+		if c.IsSet("scene") {
+			var err error
+			scene, err = controller.SceneByName(c.String("scene"))
+			if err != nil {
+				return err
+			}
+		}
+		change = append(change, func(state *controller.State) {
+			if scene != controller.SceneNone {
+				state.SceneId = uint(scene)
+			}
+			if state.SceneId != 0 {
+				state.Speed = speed
+			}
+		})
+	}
+	if len(change) == 0 {
+		return errors.New("nothing to set (see --help)")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+
+	wiz, transport, err := connect(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	defer wiz.Stop()
+
+	// Bulbs silently ignore what they cannot do (or reject the whole change) - better tell
+	caps := wiz.Capabilities()
+	unsupported := func(what string) error {
+		return fmt.Errorf("bulb %s (%s) does not support %s", wiz.Addr(), wiz.Firmware().ModuleName, what)
+	}
+	switch {
+	case caps.Outlet && (c.IsSet("brightness") || modes > 0 || c.IsSet("speed")):
+		return fmt.Errorf("%s (%s) is a plug, it can only be turned --on or --off", wiz.Addr(), wiz.Firmware().ModuleName)
+	case c.IsSet("brightness") && !caps.Dimmable:
+		return unsupported("brightness")
+	case (c.IsSet("rgb") || c.IsSet("hex")) && !caps.Color:
+		return unsupported("colors")
+	case c.IsSet("kelvin") && !caps.TunableWhite:
+		return unsupported("white temperatures")
+	case (c.IsSet("scene") || c.IsSet("speed")) && !caps.Color && !caps.TunableWhite:
+		return unsupported("scenes")
+	case c.IsSet("kelvin") && (kelvin < caps.KelvinMin || kelvin > caps.KelvinMax):
+		return fmt.Errorf("kelvin must be between %d and %d for this bulb (got %d)", caps.KelvinMin, caps.KelvinMax, kelvin)
+	case c.IsSet("speed") && !c.IsSet("scene") && wiz.Scene() == controller.SceneNone:
+		return errors.New("the bulb is not playing a scene, there is no speed to set (see --scene)")
+	}
+
+	return wiz.Update(ctx, func(state *controller.State) {
+		for _, f := range change {
+			f(state)
+		}
 	})
+}
 
-	t.Start()
+// Parse a color given as "r,g,b" (0-255)
+func parseRGB(value string) (r uint, g uint, b uint, err error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("rgb must be given as r,g,b (got %q)", value)
+	}
+	components := [3]uint{}
+	for i, part := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("rgb components must be between 0 and 255 (got %q)", part)
+		}
+		components[i] = uint(v)
+	}
+	return components[0], components[1], components[2], nil
+}
+
+// Parse a color given as "#rrggbb" (or "rrggbb")
+func parseHex(value string) (r uint, g uint, b uint, err error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	v, err := strconv.ParseUint(hex, 16, 24)
+	if err != nil || len(hex) != 6 {
+		return 0, 0, 0, fmt.Errorf("hex color must be given as #rrggbb (got %q)", value)
+	}
+	return uint(v >> 16 & 0xff), uint(v >> 8 & 0xff), uint(v & 0xff), nil
+}
 
+func discover(c *cli.Context) error {
+	out := results()
+	bulbs, err := discovery.Discover(c.String("broadcast"), c.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		j, err := json.MarshalIndent(bulbs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(j))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tIP\tMODULE\tFIRMWARE")
+	for _, bulb := range bulbs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", bulb.Mac, bulb.IP, bulb.Firmware.ModuleName, bulb.Firmware.FwVersion)
+	}
+	return w.Flush()
+}
+
+func simulate(c *cli.Context) error {
+	host, port, err := net.SplitHostPort(c.String("listen"))
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return fmt.Errorf("%s is not an ipv4 address", host)
+	}
+	mac, err := strconv.ParseUint(c.String("mac"), 16, 48)
+	if err != nil {
+		return fmt.Errorf("%s is not a mac address: %v", c.String("mac"), err)
+	}
+
+	// Additional bulbs get the next ips (and macs), as the port is fixed for actual bulbs
+	for i := 0; i < c.Int("count"); i++ {
+		bulb := simulator.NewBulb(fmt.Sprintf("%012x", mac+uint64(i)))
+		bulb.ModuleName = c.String("model")
+		bulb.FwVersion = c.String("firmware")
+		bulb.Latency = c.Duration("latency")
+		bulb.Loss = c.Float64("loss")
+		bulb.ErrorRate = c.Float64("errors")
+		bulb.SyncInterval = c.Duration("sync-interval")
+		bulb.SyncPort = c.Int("sync-port")
+
+		address := net.IPv4(ip[0], ip[1], ip[2], ip[3]+byte(i)).String()
+		err = bulb.Listen(net.JoinHostPort(address, port))
+		if err != nil {
+			return err
+		}
+		defer bulb.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
 	return nil
 }
 
+// Address of a bulb from an ip, using the standard port unless one is specified (eg: for simulated bulbs)
+func bulbAddress(ip string) string {
+	if _, _, err := net.SplitHostPort(ip); err == nil {
+		return ip
+	}
+	return net.JoinHostPort(ip, fmt.Sprint(discovery.PORT))
+}
+
+// Send every diagnostic to stderr, so that the output of a command can be piped (eg: --json)
+// Returns the actual stdout, for the command to print its results on
+func results() *os.File {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	return out
+}
+
 /*
 info := accessory.Info{
 Name: "WizLamp",
@@ -119,48 +990,315 @@ func main() {
 			Action: register,
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "pin",
-					Value: "87654312",
-					Usage: "Pin code for your device (8 characters)",
+					Name:   "config",
+					EnvVar: "CONFIG",
+					Usage:  "YAML file describing the bridge and its bulbs - flags override it",
+				},
+				cli.DurationFlag{
+					Name:   "config-watch",
+					EnvVar: "CONFIG_WATCH",
+					Value:  2 * time.Second,
+					Usage:  "How often to check the config file for changes, reloading it when it changed (0 to only reload on SIGHUP)",
+				},
+				cli.StringFlag{
+					Name:   "pin",
+					EnvVar: "HOMEKIT_PIN",
+					Value:  "87654312",
+					Usage:  "Pin code for your device (8 characters)",
 				},
 				cli.StringFlag{
-					Name:  "port",
-					Value: "12345",
-					Usage: "Port to expose the service on",
+					Name:   "port",
+					EnvVar: "HOMEKIT_PORT",
+					Value:  "12345",
+					Usage:  "Port to expose the service on",
 				},
 				cli.StringFlag{
-					Name:  "name",
-					Value: "Dubo Dubon Duponey WizHard",
-					Usage: "Name of your Wiz bridge",
+					Name:   "name",
+					EnvVar: "HOMEKIT_NAME",
+					Value:  "Dubo Dubon Duponey WizHard",
+					Usage:  "Name of your Wiz bridge",
 				},
 				cli.StringFlag{
-					Name:  "data-path",
-					Value: "/tmp/dubo-wizhard",
-					Usage: "Where to store the data files for that device",
+					Name:   "data-path",
+					EnvVar: "HOMEKIT_DATA_PATH",
+					Value:  "/tmp/dubo-wizhard",
+					Usage:  "Where to store the data files for that device",
 				},
 				cli.StringFlag{
-					Name:  "manufacturer",
-					Value: "Dubo Dubon Duponey",
-					Usage: "Manufacturer of your bridge",
+					Name:   "manufacturer",
+					EnvVar: "HOMEKIT_MANUFACTURER",
+					Value:  "Dubo Dubon Duponey",
+					Usage:  "Manufacturer of your bridge",
 				},
 				cli.StringFlag{
-					Name:  "serial",
-					Value: uuid,
-					Usage: "Serial number of your bridge",
+					Name:   "serial",
+					EnvVar: "HOMEKIT_SERIAL",
+					Value:  uuid,
+					Usage:  "Serial number of your bridge",
 				},
 				cli.StringFlag{
-					Name:  "model",
-					Value: "WizHard Bridge",
-					Usage: "Model of your bridge",
+					Name:   "model",
+					EnvVar: "HOMEKIT_MODEL",
+					Value:  "WizHard Bridge",
+					Usage:  "Model of your bridge",
 				},
 				cli.StringFlag{
-					Name:  "version",
-					Value: "1",
-					Usage: "Firmware version of your bridge",
+					Name:   "version",
+					EnvVar: "HOMEKIT_VERSION",
+					Value:  "1",
+					Usage:  "Firmware version of your bridge",
+				},
+				cli.StringSliceFlag{
+					Name:   "ips",
+					EnvVar: "IPS",
+					Usage:  "IPs addresses of your bulbs - IPS takes them space separated",
 				},
 				cli.StringSliceFlag{
-					Name:  "ips",
-					Usage: "IPs addresses of your bulbs",
+					Name:  "scenes",
+					Usage: "Scenes to expose as switches, for all bulbs (Fireplace,Cozy) or for a given one (1.2.3.4=Fireplace,Cozy) - SCENES takes them space separated",
+				},
+				cli.StringSliceFlag{
+					Name:   "mixing",
+					EnvVar: "MIXING",
+					Usage:  "How to render colors: rgb, rgbw or rgbcw, for all bulbs (rgbcw) or for a given model (ESP01_SHRGB1C_31=rgbw) - defaults depend on the model",
+				},
+				cli.BoolTFlag{
+					Name:   "push",
+					EnvVar: "PUSH",
+					Usage:  "Listen for state changes pushed by the bulbs (on port 38900) - use --push=false to disable",
+				},
+				cli.StringFlag{
+					Name:   "push-ip",
+					EnvVar: "PUSH_IP",
+					Usage:  "Ip the bulbs should push state changes to (defaults to the local ip used to reach each bulb)",
+				},
+				cli.DurationFlag{
+					Name:   "poll-interval",
+					EnvVar: "POLL_INTERVAL",
+					Value:  controller.POLL_INTERVAL,
+					Usage:  "How often to refresh the state of the bulbs in the background",
+				},
+				cli.DurationFlag{
+					Name:   "max-staleness",
+					EnvVar: "MAX_STALENESS",
+					Value:  controller.MAX_STALENESS,
+					Usage:  "How long without news from a bulb before reporting it off",
+				},
+				cli.DurationFlag{
+					Name:   "timeout",
+					EnvVar: "TIMEOUT",
+					Value:  controller.TIMEOUT,
+					Usage:  "How long to wait for a bulb to answer",
+				},
+				cli.IntFlag{
+					Name:   "retries",
+					EnvVar: "RETRIES",
+					Value:  controller.RETRIES,
+					Usage:  "How many times to send a message to a bulb before giving up",
+				},
+				cli.DurationFlag{
+					Name:   "backoff",
+					EnvVar: "BACKOFF",
+					Value:  controller.BACKOFF,
+					Usage:  "How long to wait for a bulb to answer before sending again (doubled on every retry)",
+				},
+				cli.DurationFlag{
+					Name:   "debounce",
+					EnvVar: "DEBOUNCE",
+					Value:  controller.DEBOUNCE,
+					Usage:  "How long to accumulate changes from HomeKit before writing them to a bulb (0 to write every change)",
+				},
+				cli.BoolFlag{
+					Name:   "discover",
+					EnvVar: "DISCOVER",
+					Usage:  "Periodically look for bulbs on the network and add them to the bridge",
+				},
+				cli.StringFlag{
+					Name:   "broadcast",
+					EnvVar: "BROADCAST",
+					Value:  discovery.DEFAULT_BROADCAST,
+					Usage:  "Broadcast address of your network, used to discover bulbs and follow them when their ip changes",
+				},
+				cli.DurationFlag{
+					Name:   "discover-interval",
+					EnvVar: "DISCOVER_INTERVAL",
+					Value:  time.Minute,
+					Usage:  "How often to look for new bulbs, used with --discover",
+				},
+				cli.DurationFlag{
+					Name:   "discover-window",
+					EnvVar: "DISCOVER_WINDOW",
+					Value:  discovery.DEFAULT_WINDOW,
+					Usage:  "How long to wait for bulbs to answer broadcasts",
+				},
+			},
+		},
+		{
+			Name:      "scene",
+			Usage:     "play one of the predefined scenes on a bulb",
+			ArgsUsage: "<scene name>",
+			Action:    scene,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ip",
+					Usage: "IP address of the bulb",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: controller.TIMEOUT,
+					Usage: "How long to wait for the bulb to answer",
+				},
+				cli.UintFlag{
+					Name:  "speed",
+					Value: 100,
+					Usage: "Speed of the scene, in percent (10 to 200)",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "List the available scenes",
+				},
+			},
+		},
+		{
+			Name:   "get",
+			Usage:  "print the state and system info of a bulb",
+			Action: get,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ip",
+					Usage: "IP address of the bulb",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: controller.TIMEOUT,
+					Usage: "How long to wait for the bulb to answer",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output as json instead of text",
+				},
+			},
+		},
+		{
+			Name:   "set",
+			Usage:  "change the state of a bulb",
+			Action: set,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ip",
+					Usage: "IP address of the bulb",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: controller.TIMEOUT,
+					Usage: "How long to wait for the bulb to answer",
+				},
+				cli.BoolFlag{
+					Name:  "on",
+					Usage: "Turn the bulb on",
+				},
+				cli.BoolFlag{
+					Name:  "off",
+					Usage: "Turn the bulb off",
+				},
+				cli.UintFlag{
+					Name:  "brightness",
+					Usage: "Brightness, in percent (10 to 100)",
+				},
+				cli.StringFlag{
+					Name:  "rgb",
+					Usage: "Color, as r,g,b (0 to 255 each)",
+				},
+				cli.StringFlag{
+					Name:  "hex",
+					Usage: "Color, as #rrggbb",
+				},
+				cli.UintFlag{
+					Name:  "kelvin",
+					Usage: fmt.Sprintf("White, at that temperature (%d to %d, depending on the bulb)", controller.KELVIN_MIN, controller.KELVIN_MAX),
+				},
+				cli.StringFlag{
+					Name:  "scene",
+					Usage: "Scene to play (see wizhard scene --list)",
+				},
+				cli.UintFlag{
+					Name:  "speed",
+					Usage: fmt.Sprintf("Speed of the scene, in percent (%d to %d)", controller.SPEED_MIN, controller.SPEED_MAX),
+				},
+			},
+		},
+		{
+			Name:   "discover",
+			Usage:  "find the Wiz bulbs on your network",
+			Action: discover,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "broadcast",
+					Value: discovery.DEFAULT_BROADCAST,
+					Usage: "Broadcast address of your network",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: discovery.DEFAULT_WINDOW,
+					Usage: "How long to wait for bulbs to answer",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output as json instead of a table",
+				},
+			},
+		},
+		{
+			Name:   "simulate",
+			Usage:  "pretend to be Wiz bulbs, to play with the bridge without actual bulbs",
+			Action: simulate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: fmt.Sprintf("127.0.0.1:%d", discovery.PORT),
+					Usage: "Address to listen on - additional bulbs listen on the next ips",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Value: 1,
+					Usage: "How many bulbs to simulate",
+				},
+				cli.StringFlag{
+					Name:  "mac",
+					Value: simulator.DEFAULT_MAC,
+					Usage: "Mac address of the bulb - additional bulbs get the next ones",
+				},
+				cli.StringFlag{
+					Name:  "model",
+					Value: simulator.DEFAULT_MODULE,
+					Usage: "Module name of the bulb",
+				},
+				cli.StringFlag{
+					Name:  "firmware",
+					Value: simulator.DEFAULT_FIRMWARE,
+					Usage: "Firmware version of the bulb",
+				},
+				cli.DurationFlag{
+					Name:  "latency",
+					Usage: "How long to wait before answering",
+				},
+				cli.Float64Flag{
+					Name:  "loss",
+					Usage: "Probability (0 to 1) for a message to get lost",
+				},
+				cli.Float64Flag{
+					Name:  "errors",
+					Usage: "Probability (0 to 1) for a message to be answered with an error",
+				},
+				cli.DurationFlag{
+					Name:  "sync-interval",
+					Value: simulator.SYNC_INTERVAL,
+					Usage: "How often to push the state to the bridge, once it registered (0 to only push changes)",
+				},
+				cli.IntFlag{
+					Name:  "sync-port",
+					Value: controller.LISTENER_PORT,
+					Usage: "Port to push the state to",
 				},
 			},
 		},
@@ -224,7 +1362,13 @@ func mainOld() {
 		FirmwareRevision: "0.0.1",
 	}
 
-	ac := homekit.NewWizLightbulb("10.0.4.208:38899", info)
+	transport, err := utils.NewUDPTransport("")
+	if err != nil {
+		log.Panic(err)
+	}
+	wiz := controller.NewWizController(transport, "10.0.4.208:38899")
+	wiz.Init(context.Background())
+	ac := homekit.NewWizLightbulb(wiz, info)
 
 	// configure the ip transport
 	config := hc.Config{Pin: "14041976"}
@@ -0,0 +1,221 @@
+// Package config describes the bridge and its bulbs in a YAML file
+package config
+
+import (
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Config is the bridge, and the bulbs it exposes
+// Zero values are unset, and left for flags (or their defaults) to decide
+type Config struct {
+	Bridge Bridge `yaml:"bridge"`
+
+	// Defaults for all bulbs
+	Timeout      time.Duration `yaml:"timeout"`
+	Retries      int           `yaml:"retries"`
+	PollInterval time.Duration `yaml:"poll-interval"`
+	MaxStaleness time.Duration `yaml:"max-staleness"`
+	Debounce     time.Duration `yaml:"debounce"`
+	Scenes       []string      `yaml:"scenes"`
+
+	Bulbs []Bulb `yaml:"bulbs"`
+}
+
+// Bridge is the HomeKit bridge itself
+type Bridge struct {
+	Name         string `yaml:"name"`
+	Pin          string `yaml:"pin"`
+	Port         string `yaml:"port"`
+	DataPath     string `yaml:"data-path"`
+	Manufacturer string `yaml:"manufacturer"`
+	Serial       string `yaml:"serial"`
+	Model        string `yaml:"model"`
+	Version      string `yaml:"version"`
+}
+
+// Bulb is a bulb (or plug) to expose - identified by address, or by mac (and then found by broadcasting)
+type Bulb struct {
+	// Ip of the bulb, with an optional port
+	Address string `yaml:"address"`
+	// Mac address of the bulb, as reported by the bulb (eg: a8bb50e4f2c1)
+	Mac string `yaml:"mac"`
+
+	// Name displayed in HomeKit - defaults to Wiz N
+	Name string `yaml:"name"`
+	// HomeKit does not let accessories pick their room: this only prefixes the name (eg: Kitchen Ceiling)
+	Room string `yaml:"room"`
+
+	// Module name to go with instead of the one the bulb reports (see controller.Capabilities)
+	Model string `yaml:"model"`
+	// How to render colors (see controller.Mixing)
+	Mixing string `yaml:"mixing"`
+	// Scenes to expose as switches - overrides the defaults
+	Scenes []string `yaml:"scenes"`
+
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"`
+}
+
+// Name displayed in HomeKit, or empty if none was configured
+func (b Bulb) DisplayName() string {
+	if b.Name == "" {
+		return ""
+	}
+	return strings.TrimSpace(b.Room + " " + b.Name)
+}
+
+// Load reads and validates a configuration file - unknown keys are errors, as they are likely typos
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+
+	for i := range config.Bulbs {
+		config.Bulbs[i].Mac = NormalizeMac(config.Bulbs[i].Mac)
+	}
+
+	// Flags have not been applied yet, so a missing pin is fine at this point
+	err = config.validate(false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks the configuration, reporting every problem found at once
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+func (c *Config) validate(complete bool) error {
+	problems := []string{}
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.Bridge.Pin != "" || complete {
+		if err := ValidatePin(c.Bridge.Pin); err != nil {
+			problem("bridge: %v", err)
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{{"timeout", c.Timeout}, {"poll-interval", c.PollInterval}, {"max-staleness", c.MaxStaleness}, {"debounce", c.Debounce}}
+	for _, d := range durations {
+		if d.value < 0 {
+			problem("%s: cannot be negative (got %s)", d.name, d.value)
+		}
+	}
+	// Zero means unset until flags are applied - after that, a bulb cannot be polled (or trusted) that often
+	if complete && c.PollInterval == 0 {
+		problem("poll-interval: cannot be zero")
+	}
+	if complete && c.MaxStaleness == 0 {
+		problem("max-staleness: cannot be zero")
+	}
+	if c.Retries < 0 {
+		problem("retries: cannot be negative (got %d)", c.Retries)
+	}
+	for _, name := range c.Scenes {
+		if _, err := controller.SceneByName(name); err != nil {
+			problem("scenes: %v", err)
+		}
+	}
+
+	addresses := map[string]int{}
+	macs := map[string]int{}
+	for i, b := range c.Bulbs {
+		where := fmt.Sprintf("bulbs[%d]", i)
+		if b.Name != "" {
+			where = fmt.Sprintf("bulbs[%d] (%s)", i, b.Name)
+		}
+
+		if b.Address == "" && b.Mac == "" {
+			problem("%s: needs an address or a mac", where)
+		}
+		if b.Address != "" {
+			host := b.Address
+			if h, _, err := net.SplitHostPort(b.Address); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) == nil {
+				problem("%s: address %q is not an ip (or ip:port)", where, b.Address)
+			}
+			if j, ok := addresses[b.Address]; ok {
+				problem("%s: address %s is already used by bulbs[%d]", where, b.Address, j)
+			}
+			addresses[b.Address] = i
+		}
+		if b.Mac != "" {
+			if len(b.Mac) != 12 || strings.Trim(b.Mac, "0123456789abcdef") != "" {
+				problem("%s: mac %q is not a mac address", where, b.Mac)
+			}
+			if j, ok := macs[b.Mac]; ok {
+				problem("%s: mac %s is already used by bulbs[%d]", where, b.Mac, j)
+			}
+			macs[b.Mac] = i
+		}
+		if b.Room != "" && b.Name == "" {
+			problem("%s: a room needs a name to go with", where)
+		}
+		if b.Mixing != "" {
+			if _, err := controller.MixingByName(b.Mixing); err != nil {
+				problem("%s: %v", where, err)
+			}
+		}
+		for _, name := range b.Scenes {
+			if _, err := controller.SceneByName(name); err != nil {
+				problem("%s: %v", where, err)
+			}
+		}
+		if b.Timeout < 0 {
+			problem("%s: timeout cannot be negative (got %s)", where, b.Timeout)
+		}
+		if b.Retries < 0 {
+			problem("%s: retries cannot be negative (got %d)", where, b.Retries)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// Pins HomeKit refuses, as too easy to guess
+var trivialPins = map[string]bool{
+	"00000000": true, "11111111": true, "22222222": true, "33333333": true, "44444444": true,
+	"55555555": true, "66666666": true, "77777777": true, "88888888": true, "99999999": true,
+	"12345678": true, "87654321": true,
+}
+
+// ValidatePin checks that a HomeKit pin is made of 8 digits, and not one HomeKit refuses
+func ValidatePin(pin string) error {
+	if len(pin) != 8 || strings.Trim(pin, "0123456789") != "" {
+		return fmt.Errorf("pin must be 8 digits (got %q)", pin)
+	}
+	if trivialPins[pin] {
+		return fmt.Errorf("pin %s is too easy to guess, HomeKit will refuse it", pin)
+	}
+	return nil
+}
+
+// NormalizeMac returns a mac address the way bulbs report it (lowercase, no separators)
+func NormalizeMac(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(mac)))
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"strings"
+)
+
+// Capabilities describes what a Wiz device can do
+type Capabilities struct {
+	// Brightness can be set
+	Dimmable bool
+	// Color temperature can be set
+	TunableWhite bool
+	// Colors can be set
+	Color bool
+	// A plug rather than a light - on or off, nothing else
+	Outlet bool
+	// Range of whites supported, in kelvins - only meaningful for tunable whites
+	KelvinMin uint
+	KelvinMax uint
+}
+
+// Known devices, identified by a marker in their module name (eg: ESP01_SHRGB1C_31 is a color bulb)
+// First match wins
+var capabilities = []struct {
+	marker       string
+	capabilities Capabilities
+}{
+	// Full color bulbs, with tunable whites
+	{"SHRGB", Capabilities{Dimmable: true, TunableWhite: true, Color: true, KelvinMin: KELVIN_MIN, KelvinMax: KELVIN_MAX}},
+	// Tunable whites, which do not go as warm
+	{"SHTW", Capabilities{Dimmable: true, TunableWhite: true, KelvinMin: 2700, KelvinMax: KELVIN_MAX}},
+	// Dimmable whites, at a fixed temperature
+	{"SHDW", Capabilities{Dimmable: true}},
+	// Plugs, on or off
+	{"SOCKET", Capabilities{Outlet: true}},
+}
+
+// CapabilitiesFor returns the capabilities of a device from its module name (as reported in Firmware.ModuleName),
+// refined with its model configuration when the device answered getModelConfig
+// Anything we do not know about is assumed to be a full color bulb
+func CapabilitiesFor(moduleName string, model ModelConfig) Capabilities {
+	caps := capabilities[0].capabilities
+	for _, known := range capabilities {
+		if strings.Contains(moduleName, known.marker) {
+			caps = known.capabilities
+			break
+		}
+	}
+
+	if !caps.TunableWhite {
+		return caps
+	}
+
+	// Newer firmwares know better than our table
+	for _, r := range [][]uint{model.ExtRange, model.WhiteRange, model.CctRange} {
+		if len(r) >= 2 && r[0] > 0 && r[0] < r[len(r)-1] {
+			caps.KelvinMin = r[0]
+			caps.KelvinMax = r[len(r)-1]
+			break
+		}
+	}
+	return caps
+}
+
+// Clamp a temperature (in kelvins) to the supported range
+func (caps Capabilities) clamp(kelvin uint) uint {
+	if kelvin < caps.KelvinMin {
+		return caps.KelvinMin
+	}
+	if caps.KelvinMax != 0 && kelvin > caps.KelvinMax {
+		return caps.KelvinMax
+	}
+	return kelvin
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"github.com/lucasb-eyer/go-colorful"
+	"math"
+)
+
+// Current color of the bulb (components in the 0-1 range, white diodes included), approximated from the temperature if the bulb is in white mode
+// Brightness is not part of it (see Dimming): colors are always at full value
+func (s State) color() colorful.Color {
+	if s.Temp != 0 {
+		return kelvinToColor(s.Temp)
+	}
+	r, g, b := unmix(s.R, s.G, s.B, s.C, s.W)
+	return colorful.Color{R: float64(r) / 255, G: float64(g) / 255, B: float64(b) / 255}
+}
+
+// HsvToRGB converts a HomeKit hue (in degrees) and saturation (in percent) into rgb channels (0-255) at full value
+func HsvToRGB(hue float64, saturation float64) (r uint, g uint, b uint) {
+	c := colorful.Hsv(math.Mod(math.Max(hue, 0), 360), math.Max(0, math.Min(100, saturation))/100, 1)
+	return channel(c.R), channel(c.G), channel(c.B)
+}
+
+// RGBToHsv converts rgb channels (0-255) into a HomeKit hue (in degrees) and saturation (in percent)
+// Black has no hue or saturation to speak of: it is reported as white
+func RGBToHsv(r uint, g uint, b uint) (hue float64, saturation float64) {
+	return colorToHsv(State{R: r, G: g, B: b}.color())
+}
+
+// Hue (in degrees) and saturation (in percent) of a color, rounded the way HomeKit expects them
+func colorToHsv(c colorful.Color) (hue float64, saturation float64) {
+	h, s, _ := c.Hsv()
+	return math.Round(h), math.Round(s * 100)
+}
+
+// Channel value (0-255) of a color component (0-1)
+func channel(component float64) uint {
+	return uint(math.Round(math.Max(0, math.Min(1, component)) * 255))
+}
+
+// MiredToKelvin converts a HomeKit color temperature (in mireds) into kelvins, clamped to what the bulbs support
+func MiredToKelvin(mired int) uint {
+	if mired <= 0 {
+		return KELVIN_MAX
+	}
+	kelvin := uint(math.Round(1000000 / float64(mired)))
+	if kelvin < KELVIN_MIN {
+		return KELVIN_MIN
+	}
+	if kelvin > KELVIN_MAX {
+		return KELVIN_MAX
+	}
+	return kelvin
+}
+
+// KelvinToMired converts a temperature in kelvins into a HomeKit color temperature (in mireds)
+func KelvinToMired(kelvin uint) int {
+	if kelvin == 0 {
+		return 0
+	}
+	return int(math.Round(1000000 / float64(kelvin)))
+}
+
+// Approximate rgb rendering of a white temperature (Tanner Helland algorithm), components in the 0-1 range
+func kelvinToColor(kelvin uint) colorful.Color {
+	t := float64(kelvin) / 100
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(255, v))
+	}
+
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = clamp(99.4708025861*math.Log(t) - 161.1195681661)
+	} else {
+		r = clamp(329.698727446 * math.Pow(t-60, -0.1332047592))
+		g = clamp(288.1221695283 * math.Pow(t-60, -0.0755148492))
+	}
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = clamp(138.5177312231*math.Log(t-10) - 305.0447927307)
+	}
+	return colorful.Color{R: r / 255, G: g / 255, B: b / 255}
+}
@@ -0,0 +1,113 @@
+package controller_test
+
+import (
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"math"
+	"testing"
+)
+
+func TestHsvToRGB(t *testing.T) {
+	cases := []struct {
+		hue        float64
+		saturation float64
+		r, g, b    uint
+	}{
+		{0, 100, 255, 0, 0},
+		{120, 100, 0, 255, 0},
+		{240, 100, 0, 0, 255},
+		{60, 100, 255, 255, 0},
+		{30, 50, 255, 191, 128},
+		{200, 0, 255, 255, 255},
+		// Out of range values are wrapped (hue) or clamped (saturation)
+		{360, 100, 255, 0, 0},
+		{480, 100, 0, 255, 0},
+		{-10, 150, 255, 0, 0},
+		{0, -20, 255, 255, 255},
+	}
+
+	for _, c := range cases {
+		r, g, b := controller.HsvToRGB(c.hue, c.saturation)
+		if r != c.r || g != c.g || b != c.b {
+			t.Errorf("HsvToRGB(%v, %v): expected %d,%d,%d, got %d,%d,%d", c.hue, c.saturation, c.r, c.g, c.b, r, g, b)
+		}
+	}
+}
+
+func TestRGBToHsv(t *testing.T) {
+	cases := []struct {
+		r, g, b    uint
+		hue        float64
+		saturation float64
+	}{
+		{255, 0, 0, 0, 100},
+		{0, 255, 0, 120, 100},
+		{0, 0, 255, 240, 100},
+		{255, 191, 128, 30, 50},
+		{255, 255, 255, 0, 0},
+		{128, 128, 128, 0, 0},
+		// No hue or saturation to speak of
+		{0, 0, 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		hue, saturation := controller.RGBToHsv(c.r, c.g, c.b)
+		if hue != c.hue || saturation != c.saturation {
+			t.Errorf("RGBToHsv(%d, %d, %d): expected %v,%v, got %v,%v", c.r, c.g, c.b, c.hue, c.saturation, hue, saturation)
+		}
+	}
+}
+
+// Going through 8 bits channels loses some precision, but not more than a degree or a percent where hue is meaningful
+func TestHsvRoundTrip(t *testing.T) {
+	for hue := 0.0; hue < 360; hue++ {
+		for saturation := 20.0; saturation <= 100; saturation++ {
+			h, s := controller.RGBToHsv(controller.HsvToRGB(hue, saturation))
+			dh := math.Abs(h - hue)
+			if dh > 180 {
+				dh = 360 - dh
+			}
+			if dh > 1 || math.Abs(s-saturation) > 1 {
+				t.Fatalf("%v,%v came back as %v,%v", hue, saturation, h, s)
+			}
+		}
+	}
+}
+
+func TestMiredToKelvin(t *testing.T) {
+	cases := []struct {
+		mired  int
+		kelvin uint
+	}{
+		{250, 4000},
+		{370, 2703},
+		// Clamped to what the bulbs support
+		{140, controller.KELVIN_MAX},
+		{500, controller.KELVIN_MIN},
+		{0, controller.KELVIN_MAX},
+		{-1, controller.KELVIN_MAX},
+	}
+
+	for _, c := range cases {
+		if kelvin := controller.MiredToKelvin(c.mired); kelvin != c.kelvin {
+			t.Errorf("MiredToKelvin(%d): expected %d, got %d", c.mired, c.kelvin, kelvin)
+		}
+	}
+}
+
+func TestKelvinToMired(t *testing.T) {
+	cases := []struct {
+		kelvin uint
+		mired  int
+	}{
+		{2700, 370},
+		{4000, 250},
+		{6500, 154},
+		{0, 0},
+	}
+
+	for _, c := range cases {
+		if mired := controller.KelvinToMired(c.kelvin); mired != c.mired {
+			t.Errorf("KelvinToMired(%d): expected %d, got %d", c.kelvin, c.mired, mired)
+		}
+	}
+}
@@ -1,15 +1,6 @@
 // Package controller exposes a generic client to communicate with a single Wiz Bulb
 package controller
 
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"github.com/dubo-dubon-duponey/wizhard/utils"
-	"github.com/lucasb-eyer/go-colorful"
-	"math"
-)
-
 // State represents the current or desired state of the wiz bulb
 // It is being returned by a call to getPilot and should be passed as parameters to setPilot
 type State struct {
@@ -22,55 +13,15 @@ type State struct {
 	Rssi int `json:"rssi,omitempty"`
 	// Doesn't seem to do anything - echoed by the bulb, defaults to udp
 	Src string `json:"src,omitempty"`
-	// Speed - sets the color changing speed in percent - XXX not implemented for now
+	// Speed - sets the color changing speed of scenes in percent
 	Speed uint `json:"speed,omitempty"`
-	// Temp - sets color temperature in kelvins - XXX not implemented for now
+	// Temp - sets color temperature in kelvins (white mode) - if non zero, rgb values are ignored
 	Temp uint `json:"temp,omitempty"`
 	// schdPsetId - rhythm id of the room - XXX not implemented for now
 	SchdPsetId uint `json:"schdPsetId,omitempty"`
-	/*
-	   sceneId - calls one of the predefined scenes - XXX not implemented for now
-
-	       scene 0 - Red
-	       scene 0 - Green
-	       scene 0 - Blue
-	       scene 0 - Yellow
-	       scene 1 - Ocean
-	       scene 2 - Romance
-	       scene 3 - Sunset
-	       scene 4 - Party
-	       scene 5 - Fireplace
-	       scene 6 - Cozy
-	       scene 7 - Forest
-	       scene 8 - Pastel Colors
-	       scene 9 - Wake-up
-	       scene 10 - Bedtime
-	       scene 11 - Warm White
-	       scene 12 - Day light
-	       scene 13 - Cool white
-	       scene 14 - Night light
-	       scene 15 - Focus
-	       scene 16 - Relax
-	       scene 17 - True colors
-	       scene 18 - TV time
-	       scene 19 - Plant growth
-	       scene 20 - Spring
-	       scene 21 - Summer
-	       scene 22 - Fall
-	       scene 23 - Deep dive
-	       scene 24 - Jungle
-	       scene 25 - Mojito
-	       scene 26 - Club
-	       scene 27 - Christmas
-	       scene 28 - Halloween
-	       scene 29 - Candlelight
-	       scene 30 - Golden white
-	       scene 31 - Pulse
-	       scene 32 - Steampunk
-	*/
-	// XXX sceneID are problematic - if we repeat them back to the bulb while setting colors, it won't work
-	// Right now, removing the scenes entirely
-	// SceneId uint `json:"sceneId",omitempty`
+	// sceneId - one of the predefined scenes (see Scene) - zero when the bulb is in color or white mode
+	// Only sent back to the bulb when we want to play a scene: echoing it while setting colors will not work
+	SceneId uint `json:"sceneId,omitempty"`
 	/*
 	   State - on or off
 	*/
@@ -85,9 +36,9 @@ type State struct {
 	R uint `json:"r"`
 	G uint `json:"g"`
 	B uint `json:"b"`
-	// XXX not implemented for now
+	// Cold white diodes, mixed with rgb for pastels (see Mixing)
 	C uint `json:"c"`
-	// XXX not implemented for now
+	// Warm white diodes, mixed with rgb for pastels (see Mixing)
 	W uint `json:"w"`
 	/*
 	   Bulb dimmer in percent
@@ -98,20 +49,32 @@ type State struct {
 // Method to get firmware and other system infos
 const METHOD_GET_SYSTEM_CONFIG = "getSystemConfig"
 
+// Method to get the model details - only answered by recent firmwares
+const METHOD_GET_MODEL_CONFIG = "getModelConfig"
+
 // Get the bulb current state
 const METHOD_GET_PILOT = "getPilot"
 
 // Set the bulb state
 const METHOD_SET_PILOT = "setPilot"
 
-// Heartbeats sent by the bulb - XXX not implemented
+// Heartbeats pushed by the bulb to whoever registered with it
 const METHOD_SYNC_PILOT = "syncPilot"
 
 // ? - XXX not implemented
 const METHOD_PULSE = "Pulse"
 
-// Register with the bulb to receive heartbeats - XXX not implemented
-const METHOD_REGISTRATION = "Registration"
+// Register with the bulb to receive heartbeats
+const METHOD_REGISTRATION = "registration"
+
+// Coldest white supported by the bulbs, in kelvins
+const KELVIN_MAX = 6500
+
+// Warmest white supported by the bulbs, in kelvins
+const KELVIN_MIN = 2200
+
+// White used when we have nothing better to go with, in kelvins
+const KELVIN_DEFAULT = 2700
 
 // QueryMessage represents a UDP message to be sent to the bulb
 type QueryMessage struct {
@@ -119,10 +82,66 @@ type QueryMessage struct {
 	Method string `json:"method"`
 	// Not sure what is this, defaults to "pro" in all cases
 	Env string `json:"env,omitempty"`
-	// Possibly a unique id for the bulb?
+	// Request id, echoed back by the bulb so that responses can be matched with requests
 	Id uint `json:"id,omitempty"`
-	// State to pass to the bulb
-	Params State `json:"params,omitempty"`
+	// Parameters to pass to the bulb (see ColorPilot, WhitePilot, ScenePilot, DimmingPilot, SwitchPilot and Registration)
+	Params interface{} `json:"params,omitempty"`
+}
+
+// Registration is the payload sent with METHOD_REGISTRATION
+type Registration struct {
+	// Ip the bulb should push heartbeats to
+	PhoneIp string `json:"phoneIp"`
+	// Does not seem to matter, but has to be there
+	PhoneMac string `json:"phoneMac"`
+	// False to stop receiving heartbeats
+	Register bool `json:"register"`
+	// Does not seem to matter either
+	Id string `json:"id"`
+}
+
+// SyncMessage represents a METHOD_SYNC_PILOT heartbeat pushed by the bulb
+type SyncMessage struct {
+	Method string `json:"method"`
+	Env    string `json:"env,omitempty"`
+	State  State  `json:"params"`
+}
+
+// ColorPilot is the payload sent with METHOD_SET_PILOT to set the bulb to a rgb color
+type ColorPilot struct {
+	On      bool `json:"state"`
+	R       uint `json:"r"`
+	G       uint `json:"g"`
+	B       uint `json:"b"`
+	C       uint `json:"c"`
+	W       uint `json:"w"`
+	Dimming uint `json:"dimming"`
+}
+
+// WhitePilot is the payload sent with METHOD_SET_PILOT to set the bulb to white at a given temperature
+type WhitePilot struct {
+	On      bool `json:"state"`
+	Temp    uint `json:"temp"`
+	Dimming uint `json:"dimming"`
+}
+
+// DimmingPilot is the payload sent with METHOD_SET_PILOT to bulbs that only know about brightness
+type DimmingPilot struct {
+	On      bool `json:"state"`
+	Dimming uint `json:"dimming"`
+}
+
+// SwitchPilot is the payload sent with METHOD_SET_PILOT to plugs, which only know about on and off
+type SwitchPilot struct {
+	On bool `json:"state"`
+}
+
+// ScenePilot is the payload sent with METHOD_SET_PILOT to play one of the predefined scenes
+type ScenePilot struct {
+	On      bool `json:"state"`
+	SceneId uint `json:"sceneId"`
+	Speed   uint `json:"speed,omitempty"`
+	Dimming uint `json:"dimming"`
 }
 
 // Firmware represents system info returned by the bulb
@@ -156,6 +175,23 @@ type ResponseSystem struct {
 	Result Firmware `json:"result,omitempty"`
 }
 
+// ModelConfig represents model details returned by recent firmwares
+type ModelConfig struct {
+	// Range of whites, in kelvins, including the extended range some models have - [min, max]
+	ExtRange []uint `json:"extRange,omitempty"`
+	// Range of whites, in kelvins - [min, max]
+	WhiteRange []uint `json:"whiteRange,omitempty"`
+	// Range of whites, in kelvins, per white diode - [min, ..., max]
+	CctRange []uint `json:"cctRange,omitempty"`
+}
+
+// ResponseModel represents the response obtained from the bulb when querying METHOD_GET_MODEL_CONFIG
+type ResponseModel struct {
+	Method string      `json:"method"`
+	Env    string      `json:"env,omitempty"`
+	Result ModelConfig `json:"result,omitempty"`
+}
+
 // ResponseStatus represents the response obtained from the bulb when querying METHOD_GET_PILOT
 type ResponseStatus struct {
 	Method string `json:"method"`
@@ -182,271 +218,6 @@ type ResponseChange struct {
 	Error  Error  `json:"error,omitempty"`
 }
 
-type WizController struct {
-	Address string
-	State   State
-	System  Firmware
-}
-
-// Read the wiz bulb current state
-func (a *WizController) Read() (err error) {
-	message := QueryMessage{
-		Method: "getPilot",
-	}
-
-	j, _ := json.Marshal(message)
-
-	fmt.Println("Message we are sending:", string(j))
-
-	response, err := utils.UDPClient(a.Address, bytes.NewReader(j))
-	if err != nil {
-		fmt.Println("UDP client failed dramatically", err)
-		return err
-	}
-
-	fmt.Println("Response we got:", response)
-
-	data := ResponseStatus{
-		State: State{
-			On: false,
-			R:  1,
-			G:  0,
-			B:  0,
-		},
-	}
-
-	err = json.Unmarshal([]byte(response), &data)
-	if err != nil {
-		fmt.Println("Unmarshalling response failed", response, err)
-		return err
-	}
-
-	// Store the state
-	a.State = data.State
-	return nil
-}
-
-// Set the wiz bulb to desired state
-func (a *WizController) Write() (err error) {
-	// XXX deactivate the programmed scenes and shit so we do not fail dramatically
-	// a.State.SceneId = 0
-	a.State.Speed = 0
-	a.State.C = 0
-	a.State.W = 0
-	a.State.Src = "udp"
-	a.State.Cnx = "0501"
-
-	message := QueryMessage{
-		Method: "setPilot",
-		// XXX should we use this?
-		//    Id:     527,
-		Env:    "pro",
-		Params: a.State,
-	}
-
-	j, _ := json.Marshal(message)
-
-	fmt.Println("Message we are sending:", string(j))
-
-	response, err := utils.UDPClient(a.Address, bytes.NewReader(j))
-	if err != nil {
-		fmt.Println("UDP connection failed dramatically", err)
-		return err
-	}
-
-	fmt.Println("Response we got:", response)
-
-	data := ResponseChange{}
-
-	err = json.Unmarshal([]byte(response), &data)
-	if err != nil {
-		fmt.Println("Unmarshalling response failed", response, err)
-		return err
-	}
-	// XXX right now we don't do anything if the bulb responds with an error - implement proper error handling here
-	return nil
-}
-
-// Read system and firmware information
-func (a *WizController) ReadFirmwareInfo() (err error) {
-	message := QueryMessage{
-		Method: "getSystemConfig",
-	}
-
-	j, _ := json.Marshal(message)
-
-	fmt.Println("Message we are sending:", string(j))
-
-	response, err := utils.UDPClient(a.Address, bytes.NewReader(j))
-	if err != nil {
-		fmt.Println("UDP connection failed dramatically", err)
-		return err
-	}
-
-	fmt.Println("Response we got:", response)
-
-	data := ResponseSystem{}
-
-	err = json.Unmarshal([]byte(response), &data)
-	if err != nil {
-		fmt.Println("Unmarshalling response failed", response, err)
-		return err
-	}
-	a.System = data.Result
-	return nil
-}
-
-// Initialize the controller - basically get system info and current state
-func (a *WizController) Init() (err error) {
-	err = a.Read()
-	if err != nil {
-		return err
-	}
-	err = a.ReadFirmwareInfo()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Homekit hook to get whether the bulb is on or off
-func (a *WizController) GetOn() bool {
-	fmt.Println("DEBUG -> calling getOn")
-	// Refresh state - not technically necessary if we are alone managing this bulb, useful if there are competing systems that changed its state after we bootstrapped
-	err := a.Read()
-	if err != nil {
-		fmt.Println("Alas, we could not query thy noble lightbulb that appears to be dead or something")
-		return false
-	}
-	fmt.Println("DEBUG -> answering", a.State.On)
-	return a.State.On
-}
-
-// Homekit hook to set the bulb to on or off
-func (a *WizController) SetOn(value bool) {
-	fmt.Println("DEBUG -> calling setOn to", value)
-	a.State.On = value
-	err := a.Write()
-	if err != nil {
-		fmt.Println("Alas, we could not set thy noble lightbulb that appears to be dead or something")
-	}
-}
-
-// Homekit hook to read the bulb brightness
-func (a *WizController) GetBrightness() int {
-	fmt.Println("DEBUG -> calling getBrightness")
-	// Refresh state - not technically necessary if we are alone managing this bulb, useful if there are competing systems that changed its state after we bootstrapped
-	err := a.Read()
-	if err != nil {
-		fmt.Println("Alas, we could not query thy noble lightbulb that appears to be dead or something")
-		return 0
-	}
-	fmt.Println("DEBUG -> answering", a.State.Dimming)
-	return int(a.State.Dimming)
-}
-
-// Homekit hook to set the bulb brightness
-func (a *WizController) SetBrightness(value int) {
-	fmt.Println("DEBUG -> calling setBrightness to", value)
-	a.State.Dimming = uint(value)
-	err := a.Write()
-	if err != nil {
-		fmt.Println("Alas, we could not set thy noble lightbulb that appears to be dead or something")
-	}
-}
-
-// Homekit hook to read the bulb hue
-func (a *WizController) GetHue() float64 {
-	fmt.Println("DEBUG -> calling getHue")
-	// Refresh state - not technically necessary if we are alone managing this bulb, useful if there are competing systems that changed its state after we bootstrapped
-	err := a.Read()
-	if err != nil {
-		fmt.Println("Alas, we could not query the noble lightbulb that appears to be dead")
-		return 0
-	}
-	color := colorful.Color{R: float64(a.State.R), G: float64(a.State.G), B: float64(a.State.B)}
-	h, _, _ := color.Hsv()
-	fmt.Println("DEBUG -> answering", h)
-	return math.Round(h)
-	//  return 0
-}
-
-// Homekit hook to set the bulb hue
-func (a *WizController) SetHue(value float64) {
-	fmt.Println("DEBUG -> calling setHue to", value)
-
-	color := colorful.Color{R: float64(a.State.R), G: float64(a.State.G), B: float64(a.State.B)}
-	_, s, v := color.Hsv()
-
-	fmt.Println("Starting point", a.State.R, a.State.G, a.State.B)
-	fmt.Println("WizController Set Hue", value, "with s being", s, "and v", v)
-
-	hsv := colorful.Hsv(value, s, 255)
-	fmt.Println("Hue Set Red", hsv.R)
-	fmt.Println("Hue Set Green", hsv.G)
-	fmt.Println("Hue Set Blue", hsv.B)
-
-	a.State.R = uint(hsv.R)
-	a.State.G = uint(hsv.G)
-	a.State.B = uint(hsv.B)
-
-	err := a.Write()
-	if err != nil {
-		fmt.Println("Alas, we could not set thy noble lightbulb that appears to be dead or something")
-	}
-}
-
-// Homekit hook to read the bulb saturation
-func (a *WizController) GetSaturation() float64 {
-	fmt.Println("DEBUG -> calling getSaturation")
-	// Refresh state - not technically necessary if we are alone managing this bulb, useful if there are competing systems that changed its state after we bootstrapped
-	err := a.Read()
-	if err != nil {
-		fmt.Println("Alas, we could not query the noble lightbulb that appears to be dead")
-		return 0
-	}
-	color := colorful.Color{R: float64(a.State.R), G: float64(a.State.G), B: float64(a.State.B)}
-	_, s, _ := color.Hsv()
-	fmt.Println("DEBUG -> answering", s*100)
-	return math.Round(s * 100)
-}
-
-// Homekit hook to set the bulb saturation
-func (a *WizController) SetSaturation(value float64) {
-	fmt.Println("DEBUG -> calling setSaturation to", value)
-
-	color := colorful.Color{R: float64(a.State.R), G: float64(a.State.G), B: float64(a.State.B)}
-	h, _, v := color.Hsv()
-
-	fmt.Println("Starting point", a.State.R, a.State.G, a.State.B)
-	fmt.Println("WizController Set Saturation", value, "with h being", h, "and v", v)
-
-	hsv := colorful.Hsv(h, value/100, 255)
-	fmt.Println("Hue Set Red", hsv.R)
-	fmt.Println("Hue Set Green", hsv.G)
-	fmt.Println("Hue Set Blue", hsv.B)
-
-	a.State.R = uint(hsv.R)
-	a.State.G = uint(hsv.G)
-	a.State.B = uint(hsv.B)
-
-	err := a.Write()
-	if err != nil {
-		fmt.Println("Alas, we could not set thy noble lightbulb that appears to be dead or something")
-	}
-}
-
-func NewWizController(address string) *WizController {
-	wc := &WizController{
-		Address: address,
-		State:   State{},
-	}
-
-	// Init to get the current state in
-	wc.Init()
-	return wc
-}
-
 // A python implem
 // https://github.com/sbidy/pywizlight
 
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned when the bulb did not answer in time
+var ErrTimeout = errors.New("bulb did not answer in time")
+
+// Returned when the bulb answered something we do not understand
+var ErrMalformedResponse = errors.New("malformed response from bulb")
+
+// Returned (wrapped in a BulbError) when the bulb answered with an error
+var ErrBulbRejected = errors.New("bulb rejected the command")
+
+// Returned when talking to a controller that has been stopped
+var ErrStopped = errors.New("controller stopped")
+
+// BulbError is the error object the bulb answered a command with
+// errors.Is(err, ErrBulbRejected) is true for all of them
+type BulbError struct {
+	Method  string
+	Code    int64
+	Message string
+}
+
+func (e *BulbError) Error() string {
+	return fmt.Sprintf("%s: %s failed with %q (code %d)", ErrBulbRejected, e.Method, e.Message, e.Code)
+}
+
+func (e *BulbError) Unwrap() error {
+	return ErrBulbRejected
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+// Port bulbs push their heartbeats to - the shared Transport has to be bound to it for the Listener to hear them
+const LISTENER_PORT = 38900
+
+// How often we renew our registration with the bulbs - they stop pushing after a while otherwise
+const REGISTRATION_INTERVAL = 30 * time.Second
+
+// Mac address we register with - bulbs do not seem to care
+const REGISTRATION_MAC = "AAAAAAAAAAAA"
+
+// Listener registers with a set of bulbs, and dispatches the heartbeats they push to their controllers
+// Heartbeats are received on a transport, which is typically also the one shared by the controllers
+type Listener struct {
+	// Ip the bulbs should push to - if empty, the local ip used to reach each bulb is used
+	IP string
+
+	transport   *utils.UDPTransport
+	controllers map[string]*WizController
+	// Bulbs that never answered, and that we cannot tell heartbeats from yet (they are told apart by mac)
+	pending map[*WizController]bool
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewListener(ip string, transport *utils.UDPTransport) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Listener{
+		IP:          ip,
+		transport:   transport,
+		controllers: map[string]*WizController{},
+		pending:     map[*WizController]bool{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start listening for heartbeats, and keep our registrations alive
+func (l *Listener) Start() (err error) {
+	l.transport.Handle(l.handle)
+
+	go func() {
+		ticker := time.NewTicker(REGISTRATION_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-ticker.C:
+				l.mutex.Lock()
+				// Bulbs that did not answer before may have since (polled, or located elsewhere)
+				for wiz := range l.pending {
+					if mac := wiz.Mac(); mac != "" {
+						fmt.Println("Bulb at", wiz.Addr(), "finally answered, listening to its heartbeats")
+						delete(l.pending, wiz)
+						l.controllers[mac] = wiz
+					}
+				}
+				controllers := []*WizController{}
+				for _, wiz := range l.controllers {
+					controllers = append(controllers, wiz)
+				}
+				l.mutex.Unlock()
+				for _, wiz := range controllers {
+					l.register(wiz)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop listening, cancelling registrations in flight - the transport is left open
+func (l *Listener) Stop() {
+	l.cancel()
+	l.transport.Handle(nil)
+}
+
+// Add a bulb to the listener, registering with it
+// Bulbs that never answered are registered with once they do, on the next registration renewal
+func (l *Listener) Add(wiz *WizController) {
+	mac := wiz.Mac()
+	if mac == "" {
+		fmt.Println("Bulb at", wiz.Addr(), "never answered, cannot listen to its heartbeats until it does")
+		l.mutex.Lock()
+		l.pending[wiz] = true
+		l.mutex.Unlock()
+		return
+	}
+
+	l.mutex.Lock()
+	l.controllers[mac] = wiz
+	l.mutex.Unlock()
+
+	go l.register(wiz)
+}
+
+// Remove a bulb from the listener - heartbeats it keeps pushing until our registration expires are ignored
+func (l *Listener) Remove(wiz *WizController) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.pending, wiz)
+	if l.controllers[wiz.Mac()] == wiz {
+		delete(l.controllers, wiz.Mac())
+	}
+}
+
+func (l *Listener) register(wiz *WizController) {
+	ip := l.IP
+	if ip == "" {
+		var err error
+		ip, err = utils.LocalIP(wiz.Addr())
+		if err != nil {
+			fmt.Println("Cannot figure out our ip for bulb", wiz.Addr(), err)
+			return
+		}
+	}
+
+	err := wiz.Register(l.ctx, ip)
+	if err != nil {
+		fmt.Println("Failed registering with bulb", wiz.Addr(), err)
+	}
+}
+
+func (l *Listener) handle(message string, addr *net.UDPAddr) {
+	data := SyncMessage{}
+
+	err := json.Unmarshal([]byte(message), &data)
+	if err != nil {
+		fmt.Println("Unmarshalling heartbeat failed", message, err)
+		return
+	}
+
+	// Bulbs also send firstBeat when they boot, which we do not care about
+	if data.Method != METHOD_SYNC_PILOT {
+		return
+	}
+
+	l.mutex.Lock()
+	wiz, ok := l.controllers[data.State.Mac]
+	l.mutex.Unlock()
+
+	if !ok {
+		fmt.Println("Ignoring heartbeat from unknown bulb", data.State.Mac, addr)
+		return
+	}
+
+	wiz.Sync(data.State)
+}
@@ -0,0 +1,85 @@
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"github.com/dubo-dubon-duponey/wizhard/simulator"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+// A local udp port nobody uses right now
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("cannot find a free port: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// End to end, over actual sockets: the bulb pushes its state to the listener, which hands it to the controller
+func TestListenerSync(t *testing.T) {
+	listenerPort := freePort(t)
+	transport, err := utils.NewUDPTransport(fmt.Sprintf("127.0.0.1:%d", listenerPort))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer transport.Close()
+
+	bulb := simulator.NewBulb("")
+	bulb.SyncInterval = 0
+	bulb.SyncPort = listenerPort
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	err = bulb.Listen(address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer bulb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wiz := controller.NewWizController(transport, address)
+	defer wiz.Stop()
+	err = wiz.Init(ctx)
+	if err != nil || wiz.Mac() != bulb.Mac {
+		t.Fatalf("controller did not initialize from the simulated bulb: mac is %q (%v)", wiz.Mac(), err)
+	}
+
+	changes := make(chan controller.State, 10)
+	wiz.Observe(func(state controller.State) {
+		changes <- state
+	}, nil)
+
+	listener := controller.NewListener("127.0.0.1", transport)
+	err = listener.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Stop()
+	listener.Add(wiz)
+
+	// Registration happens in the background - change the bulb from elsewhere until it pushes the change to us
+	deadline := time.After(5 * time.Second)
+	for dimming := uint(11); ; dimming++ {
+		bulb.Handle(fmt.Sprintf(`{"method":"setPilot","params":{"dimming":%d}}`, dimming))
+		select {
+		case <-deadline:
+			t.Fatalf("no push reached OnChange")
+		case state := <-changes:
+			if state.Dimming < 11 {
+				t.Fatalf("pushed state is not the one the bulb was changed to: %+v", state)
+			}
+			if wiz.Brightness() != int(state.Dimming) {
+				t.Errorf("controller state was not synced: brightness is %d, pushed %d", wiz.Brightness(), state.Dimming)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Mixing is how a HomeKit color is rendered with the bulb channels
+// Pastels rendered with rgb diodes only look muddy - bulbs that have them render the white part with their white diodes instead
+type Mixing string
+
+// Rgb diodes only
+const MIXING_RGB Mixing = "rgb"
+
+// White part of colors on the warm white diodes
+const MIXING_RGBW Mixing = "rgbw"
+
+// White part of colors on both the cold and warm white diodes (a neutral white) - what the Wiz app does on color bulbs
+const MIXING_RGBCW Mixing = "rgbcw"
+
+// MixingByName returns the mixing strategy with that name (rgb, rgbw or rgbcw)
+func MixingByName(name string) (Mixing, error) {
+	m := Mixing(strings.ToLower(strings.TrimSpace(name)))
+	switch m {
+	case MIXING_RGB, MIXING_RGBW, MIXING_RGBCW:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mixing %q (expected one of %s, %s, %s)", name, MIXING_RGB, MIXING_RGBW, MIXING_RGBCW)
+}
+
+// DefaultMixing returns the mixing strategy suited to a model (as reported in Firmware.ModuleName)
+// Color bulbs (SHRGB) come with both cold and warm white diodes - anything we do not know about gets rgb only
+func DefaultMixing(moduleName string) Mixing {
+	if strings.Contains(moduleName, "SHRGB") {
+		return MIXING_RGBCW
+	}
+	return MIXING_RGB
+}
+
+// Mix a HomeKit hue (in degrees) and saturation (in percent) into channels (0-255)
+// The white part of the color (none at full saturation, everything at zero) goes to the white diodes
+func (m Mixing) mix(hue float64, saturation float64) (r uint, g uint, b uint, c uint, w uint) {
+	r, g, b = HsvToRGB(hue, saturation)
+	if m != MIXING_RGBW && m != MIXING_RGBCW {
+		return r, g, b, 0, 0
+	}
+
+	white := r
+	if g < white {
+		white = g
+	}
+	if b < white {
+		white = b
+	}
+	r, g, b = r-white, g-white, b-white
+	if m == MIXING_RGBCW {
+		return r, g, b, white, white
+	}
+	return r, g, b, 0, white
+}
+
+// Rgb rendering (0-255) of channels, white diodes included - the reverse of mix
+func unmix(r uint, g uint, b uint, c uint, w uint) (uint, uint, uint) {
+	white := c
+	if w > white {
+		white = w
+	}
+	add := func(component uint) uint {
+		return uint(math.Min(255, float64(component+white)))
+	}
+	return add(r), add(g), add(b)
+}
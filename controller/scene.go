@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scene is one of the light programs predefined in the Wiz bulbs firmware
+type Scene uint
+
+// Slowest speed accepted for scenes, in percent
+const SPEED_MIN = 10
+
+// Fastest speed accepted for scenes, in percent
+const SPEED_MAX = 200
+
+// Known scenes, by sceneId
+// Note that the Wiz app also exposes "Red", "Green", "Blue" and "Yellow" as scenes, which are just plain colors (sceneId 0)
+const (
+	SceneNone Scene = iota
+	SceneOcean
+	SceneRomance
+	SceneSunset
+	SceneParty
+	SceneFireplace
+	SceneCozy
+	SceneForest
+	ScenePastelColors
+	SceneWakeUp
+	SceneBedtime
+	SceneWarmWhite
+	SceneDaylight
+	SceneCoolWhite
+	SceneNightLight
+	SceneFocus
+	SceneRelax
+	SceneTrueColors
+	SceneTVTime
+	ScenePlantGrowth
+	SceneSpring
+	SceneSummer
+	SceneFall
+	SceneDeepDive
+	SceneJungle
+	SceneMojito
+	SceneClub
+	SceneChristmas
+	SceneHalloween
+	SceneCandlelight
+	SceneGoldenWhite
+	ScenePulse
+	SceneSteampunk
+)
+
+var sceneNames = map[Scene]string{
+	SceneNone:         "None",
+	SceneOcean:        "Ocean",
+	SceneRomance:      "Romance",
+	SceneSunset:       "Sunset",
+	SceneParty:        "Party",
+	SceneFireplace:    "Fireplace",
+	SceneCozy:         "Cozy",
+	SceneForest:       "Forest",
+	ScenePastelColors: "Pastel Colors",
+	SceneWakeUp:       "Wake-up",
+	SceneBedtime:      "Bedtime",
+	SceneWarmWhite:    "Warm White",
+	SceneDaylight:     "Day light",
+	SceneCoolWhite:    "Cool white",
+	SceneNightLight:   "Night light",
+	SceneFocus:        "Focus",
+	SceneRelax:        "Relax",
+	SceneTrueColors:   "True colors",
+	SceneTVTime:       "TV time",
+	ScenePlantGrowth:  "Plant growth",
+	SceneSpring:       "Spring",
+	SceneSummer:       "Summer",
+	SceneFall:         "Fall",
+	SceneDeepDive:     "Deep dive",
+	SceneJungle:       "Jungle",
+	SceneMojito:       "Mojito",
+	SceneClub:         "Club",
+	SceneChristmas:    "Christmas",
+	SceneHalloween:    "Halloween",
+	SceneCandlelight:  "Candlelight",
+	SceneGoldenWhite:  "Golden white",
+	ScenePulse:        "Pulse",
+	SceneSteampunk:    "Steampunk",
+}
+
+// Human readable name of the scene, as displayed in the Wiz app
+func (s Scene) String() string {
+	if name, ok := sceneNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Scene %d", uint(s))
+}
+
+// Scenes returns all playable scenes, ordered by id
+func Scenes() []Scene {
+	scenes := []Scene{}
+	for s := SceneOcean; s <= SceneSteampunk; s++ {
+		scenes = append(scenes, s)
+	}
+	return scenes
+}
+
+// SceneByName looks up a scene by name - case, spaces and dashes are ignored, so "wakeup", "Wake-up" and "WAKE UP" all work
+func SceneByName(name string) (Scene, error) {
+	wanted := normalizeSceneName(name)
+	for _, s := range Scenes() {
+		if normalizeSceneName(s.String()) == wanted {
+			return s, nil
+		}
+	}
+	return SceneNone, fmt.Errorf("unknown scene %q", name)
+}
+
+func normalizeSceneName(name string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(name))
+}
@@ -0,0 +1,14 @@
+package controller
+
+import (
+	"context"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+)
+
+// Transport carries messages to the bulbs, and brings their responses back
+// utils.UDPTransport talks to actual bulbs, utils.MemoryTransport to in-process fakes
+type Transport interface {
+	// Exchange sends message to address, retrying as told, until accept returns true for a response or ctx is done
+	// Giving up because ctx is done should return ctx.Err(), and timing out an error satisfying isTimeout
+	Exchange(ctx context.Context, address string, message []byte, retry utils.Retry, accept func(response string) bool) (string, error)
+}
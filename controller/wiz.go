@@ -0,0 +1,971 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the state is refreshed in the background, by default
+const POLL_INTERVAL = 30 * time.Second
+
+// How old the state can get before we stop vouching for it, by default
+const MAX_STALENESS = 2 * time.Minute
+
+// How long HomeKit changes are accumulated before being written to the bulb, by default
+const DEBOUNCE = 100 * time.Millisecond
+
+// How long to wait for the bulb to answer, by default
+const TIMEOUT = 3 * time.Second
+
+// How many times messages are sent before giving up on the bulb, by default
+const RETRIES = 3
+
+// How long to wait for an answer before sending again, by default - doubled on every retry
+const BACKOFF = 250 * time.Millisecond
+
+// Last request id used - ids are unique across all bulbs
+var lastId uint32
+
+// Number of consecutive timeouts after which we consider the bulb moved to a different address
+const MAX_TIMEOUTS = 3
+
+// WizController talks to a single bulb
+// It is safe for concurrent use: the state is guarded by a mutex, and all communication with the bulb goes through
+// a per-bulb queue, so that concurrent changes get merged into consistent writes instead of stepping on each other
+type WizController struct {
+	// Address of the bulb (ip:port) - use Addr once the controller is shared
+	Address string
+	// Last known (or desired) state of the bulb - use Snapshot once the controller is shared
+	State State
+	// System info of the bulb - use Firmware once the controller is shared
+	System Firmware
+	// Model details of the bulb, if it answered getModelConfig
+	model ModelConfig
+
+	// Locate finds the current address of the bulb with that mac (typically by broadcasting)
+	// It is called when the bulb stopped answering, in case it got a new DHCP lease - leave nil to disable
+	Locate func(mac string) (string, error)
+
+	// OnChange is called when the bulb pushes a new state (see Listener), or a refresh finds it changed
+	// Use Observe to change it once the controller is shared
+	OnChange func(state State)
+
+	// OnStatus is called after every write of HomeKit changes and every background refresh, with nil on success
+	// These happen asynchronously, so this is the only way to learn about their failure
+	// Use Observe to change it once the controller is shared
+	OnStatus func(err error)
+
+	// How often the state is refreshed in the background (see Poll)
+	PollInterval time.Duration
+	// How old the state can get before we stop vouching for it
+	MaxStaleness time.Duration
+	// How long HomeKit changes are accumulated before being written to the bulb - zero to write every change right away
+	Debounce time.Duration
+	// How long to wait for the bulb to answer - contexts passed to methods can only make that shorter
+	Timeout time.Duration
+	// Module name to go with instead of the one reported by the bulb - drives Capabilities and the default Mixing
+	Model string
+	// How colors are rendered with the bulb channels - if empty, DefaultMixing for the bulb model
+	Mixing Mixing
+	// How many times messages are sent before giving up on the bulb (Wi-Fi does lose packets)
+	Retries int
+	// How long to wait for an answer before sending again - doubled on every retry
+	Backoff time.Duration
+
+	// Carries messages to the bulb - typically shared by all controllers
+	transport Transport
+
+	mutex sync.Mutex
+	// State has been changed locally and not written to the bulb yet
+	dirty bool
+	// Pending write of accumulated changes
+	debounced *time.Timer
+
+	timeouts int
+	updated  time.Time
+
+	// Color as set from HomeKit (degrees and percent) - the rgb channels are derived from it, not the other way around,
+	// as going back and forth through 8 bits channels would make it drift, all the more so at low saturation
+	hue        float64
+	saturation float64
+
+	// Lifetime of the controller, for everything that does not come with its own context (HomeKit hooks, background refresh)
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue      chan command
+	closed     chan struct{}
+	refreshing int32
+	stop       chan struct{}
+}
+
+// A unit of work for the bulb queue
+type command struct {
+	ctx  context.Context
+	run  func(ctx context.Context) error
+	done chan error
+}
+
+// Process the queue until the controller is stopped
+func (a *WizController) work() {
+	for {
+		select {
+		case <-a.closed:
+			return
+		case cmd := <-a.queue:
+			cmd.done <- cmd.run(cmd.ctx)
+		}
+	}
+}
+
+// Run f on the bulb queue and wait for it to complete, or for ctx to be done
+func (a *WizController) do(ctx context.Context, f func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.closed:
+		return ErrStopped
+	case a.queue <- command{ctx: ctx, run: f, done: done}:
+	}
+	// If we give up waiting, f sees ctx done as well and will not hold the queue for long
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// Context is the lifetime of the controller, done once it is stopped
+func (a *WizController) Context() context.Context {
+	return a.ctx
+}
+
+// Mac address of the bulb, empty if the bulb never answered
+func (a *WizController) Mac() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.System.Mac != "" {
+		return a.System.Mac
+	}
+	return a.State.Mac
+}
+
+// Addr is the current address of the bulb
+func (a *WizController) Addr() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.Address
+}
+
+// Firmware returns the system info of the bulb, as last read
+func (a *WizController) Firmware() Firmware {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.System
+}
+
+// Snapshot returns a copy of the state of the bulb, as last known
+func (a *WizController) Snapshot() State {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.State
+}
+
+// Send a message to the bulb and return its response, trying to locate the bulb again if it stopped answering
+// Only ever called from the queue
+func (a *WizController) query(ctx context.Context, message QueryMessage) (string, error) {
+	message.Id = uint(atomic.AddUint32(&lastId, 1))
+	j, _ := json.Marshal(message)
+	retry := utils.Retry{
+		Attempts: a.Retries,
+		Backoff:  a.Backoff,
+	}
+	// Only take the answer to this very message - not a late one to a message we already gave up on
+	accept := func(response string) bool {
+		header := struct {
+			Method string `json:"method"`
+			Id     uint   `json:"id"`
+		}{}
+		if json.Unmarshal([]byte(response), &header) != nil {
+			// Let decode deal with it
+			return true
+		}
+		// Not all firmwares echo the id back
+		return header.Method == message.Method && (header.Id == 0 || header.Id == message.Id)
+	}
+
+	fmt.Println("Message we are sending:", string(j))
+
+	c, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+	response, err := a.transport.Exchange(c, a.Addr(), j, retry, accept)
+	if err != nil {
+		fmt.Println("UDP connection failed dramatically", err)
+		// Cancelled by the caller - this says nothing about the bulb
+		if !isTimeout(err) || ctx.Err() != nil {
+			return "", err
+		}
+		err = fmt.Errorf("%w: %s (%v)", ErrTimeout, a.Addr(), err)
+
+		a.mutex.Lock()
+		a.timeouts++
+		timeouts := a.timeouts
+		a.mutex.Unlock()
+
+		mac := a.Mac()
+		if timeouts < MAX_TIMEOUTS || a.Locate == nil || mac == "" {
+			return "", err
+		}
+
+		// The bulb has been silent for a while - did it move?
+		a.mutex.Lock()
+		a.timeouts = 0
+		previous := a.Address
+		a.mutex.Unlock()
+
+		address, e := a.Locate(mac)
+		if e != nil || address == "" || address == previous {
+			fmt.Println("Could not locate bulb", mac, "elsewhere", e)
+			return "", err
+		}
+		fmt.Println("Bulb", mac, "moved from", previous, "to", address)
+
+		a.mutex.Lock()
+		a.Address = address
+		a.mutex.Unlock()
+
+		c, cancel := context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+		response, err = a.transport.Exchange(c, address, j, retry, accept)
+		if err != nil {
+			fmt.Println("UDP connection failed dramatically", err)
+			if isTimeout(err) && ctx.Err() == nil {
+				err = fmt.Errorf("%w: %s (%v)", ErrTimeout, address, err)
+			}
+			return "", err
+		}
+	}
+
+	a.mutex.Lock()
+	a.timeouts = 0
+	a.mutex.Unlock()
+
+	fmt.Println("Response we got:", response)
+	return response, nil
+}
+
+// Whether the bulb did not answer in time, as opposed to other network errors
+func isTimeout(err error) bool {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Decode the bulb response to method into data
+func decode(method string, response string, data interface{}) error {
+	err := json.Unmarshal([]byte(response), data)
+	if err != nil {
+		fmt.Println("Unmarshalling response failed", response, err)
+		return fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+
+	// Whatever the method, errors come back the same way
+	header := struct {
+		Method string `json:"method"`
+		Error  Error  `json:"error,omitempty"`
+	}{}
+	_ = json.Unmarshal([]byte(response), &header)
+	if header.Error.Code != 0 || header.Error.Message != "" {
+		return &BulbError{
+			Method:  method,
+			Code:    header.Error.Code,
+			Message: header.Error.Message,
+		}
+	}
+	if header.Method != method {
+		return fmt.Errorf("%w: expected an answer to %s, got %q", ErrMalformedResponse, method, header.Method)
+	}
+	return nil
+}
+
+// Read the wiz bulb current state
+func (a *WizController) Read(ctx context.Context) (err error) {
+	return a.do(ctx, a.read)
+}
+
+func (a *WizController) read(ctx context.Context) (err error) {
+	message := QueryMessage{
+		Method: METHOD_GET_PILOT,
+	}
+
+	response, err := a.query(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	data := ResponseStatus{
+		State: State{
+			On: false,
+			R:  1,
+			G:  0,
+			B:  0,
+		},
+	}
+
+	err = decode(METHOD_GET_PILOT, response, &data)
+	if err != nil {
+		return err
+	}
+
+	// Store the state - unless we have local changes waiting to be written, which are more recent
+	a.mutex.Lock()
+	changed := !a.dirty && a.State != data.State
+	if !a.dirty {
+		a.State = data.State
+		a.follow(data.State)
+	}
+	a.updated = time.Now()
+	onChange := a.OnChange
+	a.mutex.Unlock()
+
+	// Someone else changed the bulb (or a write of ours did not go through)
+	if changed && onChange != nil {
+		onChange(data.State)
+	}
+	return nil
+}
+
+// Set the wiz bulb to desired state
+func (a *WizController) Write(ctx context.Context) (err error) {
+	a.mutex.Lock()
+	a.dirty = true
+	a.mutex.Unlock()
+
+	return a.do(ctx, a.flush)
+}
+
+// Write the state to the bulb if it changed - several changes queued before us are written at once
+func (a *WizController) flush(ctx context.Context) (err error) {
+	a.mutex.Lock()
+	if !a.dirty {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.dirty = false
+	state := a.State
+	a.mutex.Unlock()
+
+	return a.write(ctx, state)
+}
+
+func (a *WizController) write(ctx context.Context, state State) (err error) {
+	// Scene, white mode and color mode are exclusive - the bulb will ignore the temperature if we send rgb values as well,
+	// and color changes fail if we repeat the scene back
+	// Simpler devices only take what they know about
+	caps := a.Capabilities()
+	var params interface{}
+	if caps.Outlet {
+		params = SwitchPilot{
+			On: state.On,
+		}
+	} else if !caps.Color && !caps.TunableWhite {
+		params = DimmingPilot{
+			On:      state.On,
+			Dimming: state.Dimming,
+		}
+	} else if state.SceneId != 0 {
+		params = ScenePilot{
+			On:      state.On,
+			SceneId: state.SceneId,
+			Speed:   state.Speed,
+			Dimming: state.Dimming,
+		}
+	} else if state.Temp != 0 {
+		params = WhitePilot{
+			On:      state.On,
+			Temp:    state.Temp,
+			Dimming: state.Dimming,
+		}
+	} else {
+		params = ColorPilot{
+			On:      state.On,
+			R:       state.R,
+			G:       state.G,
+			B:       state.B,
+			C:       state.C,
+			W:       state.W,
+			Dimming: state.Dimming,
+		}
+	}
+
+	message := QueryMessage{
+		Method: METHOD_SET_PILOT,
+		// Id is set by query
+		Env:    "pro",
+		Params: params,
+	}
+
+	response, err := a.query(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	data := ResponseChange{}
+
+	err = decode(METHOD_SET_PILOT, response, &data)
+	if err != nil {
+		return err
+	}
+	if !data.Result.Success {
+		return &BulbError{
+			Method:  METHOD_SET_PILOT,
+			Message: "no success reported",
+		}
+	}
+	return nil
+}
+
+// Update changes the state as told, and writes it to the bulb right away
+// change is called with the controller locked: it should not call the controller
+func (a *WizController) Update(ctx context.Context, change func(state *State)) error {
+	return a.update(ctx, func(state *State) {
+		change(state)
+		a.follow(*state)
+	})
+}
+
+// Change the state locally and write it to the bulb
+func (a *WizController) update(ctx context.Context, change func(state *State)) error {
+	a.mutex.Lock()
+	change(&a.State)
+	a.dirty = true
+	a.mutex.Unlock()
+
+	return a.do(ctx, a.flush)
+}
+
+// Change the state locally, and write it to the bulb once the debounce window is over
+// Dragging the color wheel in the Home app fires a burst of changes: they are merged and written at most once per window,
+// and the last one is always written, as any change after a write opens a new window
+func (a *WizController) schedule(change func(state *State)) {
+	a.mutex.Lock()
+	change(&a.State)
+	a.dirty = true
+	if a.Debounce <= 0 {
+		a.mutex.Unlock()
+		a.flushDebounced()
+		return
+	}
+	if a.debounced == nil {
+		a.debounced = time.AfterFunc(a.Debounce, a.flushDebounced)
+	}
+	a.mutex.Unlock()
+}
+
+func (a *WizController) flushDebounced() {
+	a.mutex.Lock()
+	a.debounced = nil
+	a.mutex.Unlock()
+
+	err := a.do(a.ctx, a.flush)
+	// Stop wrote our changes already
+	if errors.Is(err, ErrStopped) {
+		return
+	}
+	if err != nil {
+		fmt.Println("Alas, we could not set thy noble lightbulb that appears to be dead or something", err)
+	}
+	a.status(err)
+
+	// The bulb is alive but did not take our changes - get back in sync with what it really does
+	if errors.Is(err, ErrBulbRejected) || errors.Is(err, ErrMalformedResponse) {
+		go a.refresh()
+	}
+}
+
+func (a *WizController) status(err error) {
+	a.mutex.Lock()
+	onStatus := a.OnStatus
+	a.mutex.Unlock()
+
+	if onStatus != nil {
+		onStatus(err)
+	}
+}
+
+// Read system and firmware information
+func (a *WizController) ReadFirmwareInfo(ctx context.Context) (err error) {
+	return a.do(ctx, a.readFirmwareInfo)
+}
+
+func (a *WizController) readFirmwareInfo(ctx context.Context) (err error) {
+	message := QueryMessage{
+		Method: METHOD_GET_SYSTEM_CONFIG,
+	}
+
+	response, err := a.query(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	data := ResponseSystem{}
+
+	err = decode(METHOD_GET_SYSTEM_CONFIG, response, &data)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.System = data.Result
+	a.mutex.Unlock()
+	return nil
+}
+
+// Read model details - older firmwares do not know about getModelConfig, and answer with an error
+func (a *WizController) ReadModelConfig(ctx context.Context) (err error) {
+	return a.do(ctx, func(ctx context.Context) error {
+		message := QueryMessage{
+			Method: METHOD_GET_MODEL_CONFIG,
+		}
+
+		response, err := a.query(ctx, message)
+		if err != nil {
+			return err
+		}
+
+		data := ResponseModel{}
+
+		err = decode(METHOD_GET_MODEL_CONFIG, response, &data)
+		if err != nil {
+			return err
+		}
+
+		a.mutex.Lock()
+		a.model = data.Result
+		a.mutex.Unlock()
+		return nil
+	})
+}
+
+// What the bulb can do, from its model - everything, until we know what model it is
+func (a *WizController) Capabilities() Capabilities {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return CapabilitiesFor(a.moduleName(), a.model)
+}
+
+// Register with the bulb so that it pushes its state to ip (on LISTENER_PORT)
+func (a *WizController) Register(ctx context.Context, ip string) (err error) {
+	return a.do(ctx, func(ctx context.Context) error {
+		message := QueryMessage{
+			Method: METHOD_REGISTRATION,
+			Params: Registration{
+				PhoneIp:  ip,
+				PhoneMac: REGISTRATION_MAC,
+				Register: true,
+				Id:       "1",
+			},
+		}
+
+		response, err := a.query(ctx, message)
+		if err != nil {
+			return err
+		}
+
+		data := ResponseChange{}
+
+		err = decode(METHOD_REGISTRATION, response, &data)
+		if err != nil {
+			return err
+		}
+		if !data.Result.Success {
+			return &BulbError{
+				Method:  METHOD_REGISTRATION,
+				Message: "no success reported",
+			}
+		}
+		return nil
+	})
+}
+
+// Sync the bulb state with what the bulb pushed to us, and notify OnChange
+func (a *WizController) Sync(state State) {
+	fmt.Println("DEBUG -> bulb", a.Mac(), "pushed", state)
+
+	a.mutex.Lock()
+	// Local changes waiting to be written are more recent
+	if !a.dirty {
+		a.State = state
+		a.follow(state)
+	}
+	a.updated = time.Now()
+	state = a.State
+	onChange := a.OnChange
+	a.mutex.Unlock()
+
+	if onChange != nil {
+		onChange(state)
+	}
+}
+
+// Observe sets OnChange and OnStatus - unlike setting them directly, this is safe while the controller is in use
+func (a *WizController) Observe(onChange func(state State), onStatus func(err error)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.OnChange = onChange
+	a.OnStatus = onStatus
+}
+
+// Initialize the controller - basically get system info and current state
+func (a *WizController) Init(ctx context.Context) (err error) {
+	err = a.Read(ctx)
+	if err != nil {
+		return err
+	}
+	err = a.ReadFirmwareInfo(ctx)
+	if err != nil {
+		return err
+	}
+	// Capabilities fallback to what the module name tells us
+	if e := a.ReadModelConfig(ctx); e != nil {
+		fmt.Println("No model config for bulb", a.Addr(), e)
+	}
+	return nil
+}
+
+// Poll refreshes the state in the background every PollInterval, until Stop is called
+// Nothing is polled if PollInterval is not positive - the state is then only refreshed when it gets stale
+func (a *WizController) Poll() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.stop != nil || a.PollInterval <= 0 {
+		return
+	}
+	a.stop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.refresh()
+			}
+		}
+	}(a.stop, a.PollInterval)
+}
+
+// Stop polling and processing the queue - the controller cannot be used anymore afterwards
+// Changes not written yet are written first, then anything in flight is cancelled
+func (a *WizController) Stop() {
+	a.mutex.Lock()
+	if a.debounced != nil {
+		a.debounced.Stop()
+		a.debounced = nil
+	}
+	// Even if the debounce window is over, its write may still be waiting on the queue, and would be cancelled below
+	pending := a.dirty
+	a.mutex.Unlock()
+
+	if pending {
+		a.flushDebounced()
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+	select {
+	case <-a.closed:
+	default:
+		close(a.closed)
+	}
+	// Abort whatever is in flight
+	a.cancel()
+}
+
+// Whether the cached state is recent enough to be trusted - if not, a refresh is kicked off in the background
+func (a *WizController) fresh() bool {
+	a.mutex.Lock()
+	fresh := time.Since(a.updated) <= a.MaxStaleness
+	a.mutex.Unlock()
+
+	if !fresh {
+		go a.refresh()
+	}
+	return fresh
+}
+
+// Read the state, unless a read is already in flight
+func (a *WizController) refresh() {
+	if !atomic.CompareAndSwapInt32(&a.refreshing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.refreshing, 0)
+
+	err := a.Read(a.ctx)
+	if err != nil {
+		fmt.Println("Alas, we could not refresh thy noble lightbulb that appears to be dead or something", err)
+	}
+	a.status(err)
+}
+
+// Homekit hook to get whether the bulb is on or off
+func (a *WizController) GetOn() bool {
+	fmt.Println("DEBUG -> calling getOn")
+	// Served from the cache, refreshed in the background - a bulb we have not heard from in a while is reported off
+	if !a.fresh() {
+		fmt.Println("Alas, we have not heard from thy noble lightbulb in a while, it appears to be dead or something")
+		return false
+	}
+	fmt.Println("DEBUG -> answering", a.On())
+	return a.On()
+}
+
+// Homekit hook to set the bulb to on or off
+func (a *WizController) SetOn(value bool) {
+	fmt.Println("DEBUG -> calling setOn to", value)
+	a.schedule(func(state *State) {
+		state.On = value
+	})
+}
+
+// Homekit hook to read the bulb brightness
+func (a *WizController) GetBrightness() int {
+	fmt.Println("DEBUG -> calling getBrightness")
+	// Served from the cache, refreshed in the background
+	a.fresh()
+	fmt.Println("DEBUG -> answering", a.Brightness())
+	return a.Brightness()
+}
+
+// Homekit hook to set the bulb brightness
+func (a *WizController) SetBrightness(value int) {
+	fmt.Println("DEBUG -> calling setBrightness to", value)
+	a.schedule(func(state *State) {
+		state.Dimming = uint(value)
+	})
+}
+
+// Homekit hook to read the bulb hue
+func (a *WizController) GetHue() float64 {
+	fmt.Println("DEBUG -> calling getHue")
+	// Served from the cache, refreshed in the background
+	a.fresh()
+	fmt.Println("DEBUG -> answering", a.Hue())
+	return a.Hue()
+}
+
+// Homekit hook to set the bulb hue
+func (a *WizController) SetHue(value float64) {
+	fmt.Println("DEBUG -> calling setHue to", value)
+
+	a.schedule(func(state *State) {
+		a.hue = value
+		a.paint(state)
+	})
+}
+
+// Homekit hook to read the bulb saturation
+func (a *WizController) GetSaturation() float64 {
+	fmt.Println("DEBUG -> calling getSaturation")
+	// Served from the cache, refreshed in the background
+	a.fresh()
+	fmt.Println("DEBUG -> answering", a.Saturation())
+	return a.Saturation()
+}
+
+// Homekit hook to set the bulb saturation
+func (a *WizController) SetSaturation(value float64) {
+	fmt.Println("DEBUG -> calling setSaturation to", value)
+
+	a.schedule(func(state *State) {
+		a.saturation = value
+		a.paint(state)
+	})
+}
+
+// Switch the bulb to color mode, with the rgb channels matching the HomeKit color - mutex must be held
+func (a *WizController) paint(state *State) {
+	state.SceneId = 0
+	state.Temp = 0
+	state.R, state.G, state.B, state.C, state.W = a.mixing().mix(a.hue, a.saturation)
+	fmt.Println("DEBUG -> painting hue", a.hue, "saturation", a.saturation, "as", state.R, state.G, state.B, state.C, state.W)
+}
+
+// Mixing strategy in use - mutex must be held
+func (a *WizController) mixing() Mixing {
+	if a.Mixing != "" {
+		return a.Mixing
+	}
+	return DefaultMixing(a.moduleName())
+}
+
+// Module name of the bulb, unless overridden by Model - mutex must be held
+func (a *WizController) moduleName() string {
+	if a.Model != "" {
+		return a.Model
+	}
+	return a.System.ModuleName
+}
+
+// Catch up with a state we did not set ourselves (pushed, read, or white mode) - mutex must be held
+// The HomeKit color is kept as long as it is what the bulb displays, so that it does not drift
+func (a *WizController) follow(state State) {
+	switch {
+	case state.SceneId != 0:
+		// Scenes do not report colors - keep whatever we had
+	case state.Temp != 0:
+		a.hue, a.saturation = colorToHsv(state.color())
+	default:
+		r, g, b, c, w := a.mixing().mix(a.hue, a.saturation)
+		if r != state.R || g != state.G || b != state.B || c != state.C || w != state.W {
+			a.hue, a.saturation = colorToHsv(state.color())
+		}
+	}
+}
+
+// Homekit hook to read the bulb color temperature, in mireds
+func (a *WizController) GetColorTemperature() int {
+	fmt.Println("DEBUG -> calling getColorTemperature")
+	// Served from the cache, refreshed in the background
+	a.fresh()
+	fmt.Println("DEBUG -> answering", a.ColorTemperature())
+	return a.ColorTemperature()
+}
+
+// Homekit hook to set the bulb color temperature, in mireds
+func (a *WizController) SetColorTemperature(value int) {
+	fmt.Println("DEBUG -> calling setColorTemperature to", value)
+
+	a.schedule(func(state *State) {
+		// Switch the bulb to white mode
+		state.SceneId = 0
+		state.Temp = CapabilitiesFor(a.moduleName(), a.model).clamp(MiredToKelvin(value))
+		a.follow(*state)
+	})
+}
+
+// Play one of the predefined scenes, at the given speed (in percent, zero to let the bulb decide)
+func (a *WizController) SetScene(ctx context.Context, scene Scene, speed uint) error {
+	fmt.Println("DEBUG -> calling setScene to", scene, "at speed", speed)
+
+	if _, ok := sceneNames[scene]; !ok || scene == SceneNone {
+		return fmt.Errorf("unknown scene %d", scene)
+	}
+	if speed != 0 && (speed < SPEED_MIN || speed > SPEED_MAX) {
+		return fmt.Errorf("speed must be between %d and %d (got %d)", SPEED_MIN, SPEED_MAX, speed)
+	}
+
+	return a.update(ctx, func(state *State) {
+		state.On = true
+		state.SceneId = uint(scene)
+		state.Speed = speed
+	})
+}
+
+// Stop playing the current scene, going back to the last color or white we know of
+func (a *WizController) ClearScene(ctx context.Context) error {
+	fmt.Println("DEBUG -> calling clearScene")
+
+	return a.update(ctx, func(state *State) {
+		state.SceneId = 0
+		state.Speed = 0
+		// A bulb playing a scene does not report any color - fallback to a warm white
+		if state.Temp == 0 && state.R == 0 && state.G == 0 && state.B == 0 {
+			state.Temp = KELVIN_DEFAULT
+		}
+	})
+}
+
+// Homekit hook to read the scene currently played by the bulb
+func (a *WizController) GetScene() Scene {
+	fmt.Println("DEBUG -> calling getScene")
+	// Served from the cache, refreshed in the background
+	a.fresh()
+	fmt.Println("DEBUG -> answering", a.Scene())
+	return a.Scene()
+}
+
+// Whether the bulb is on, as last known
+func (a *WizController) On() bool {
+	return a.Snapshot().On
+}
+
+// Brightness of the bulb in percent, as last known
+func (a *WizController) Brightness() int {
+	return int(a.Snapshot().Dimming)
+}
+
+// Hue of the bulb in degrees, as last known
+func (a *WizController) Hue() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.hue
+}
+
+// Saturation of the bulb in percent, as last known
+func (a *WizController) Saturation() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.saturation
+}
+
+// Color temperature of the bulb in mireds, as last known
+func (a *WizController) ColorTemperature() int {
+	state := a.Snapshot()
+	// In color mode, there is no temperature to report - just answer the warmest white we have
+	if state.Temp == 0 {
+		return KelvinToMired(a.Capabilities().KelvinMin)
+	}
+	return KelvinToMired(state.Temp)
+}
+
+// Scene currently played by the bulb, SceneNone if the bulb is in color or white mode
+func (a *WizController) Scene() Scene {
+	return Scene(a.Snapshot().SceneId)
+}
+
+// NewWizController returns a controller for the bulb at address, that has not talked to the bulb yet
+// Settings (Timeout, Retries, etc) are to be set before calling Init, and not changed once the controller is in use
+func NewWizController(transport Transport, address string) *WizController {
+	lifetime, cancel := context.WithCancel(context.Background())
+	wc := &WizController{
+		Address:      address,
+		State:        State{},
+		transport:    transport,
+		PollInterval: POLL_INTERVAL,
+		MaxStaleness: MAX_STALENESS,
+		Debounce:     DEBOUNCE,
+		Timeout:      TIMEOUT,
+		Retries:      RETRIES,
+		Backoff:      BACKOFF,
+		ctx:          lifetime,
+		cancel:       cancel,
+		queue:        make(chan command),
+		closed:       make(chan struct{}),
+	}
+
+	go wc.work()
+	return wc
+}
@@ -0,0 +1,382 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"github.com/dubo-dubon-duponey/wizhard/simulator"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// Address simulated bulbs answer on, in memory
+const ADDRESS = "10.0.0.1:38899"
+
+// A controller talking to a simulated bulb over a MemoryTransport - call Stop when done
+func simulated(t *testing.T, bulb *simulator.Bulb) (*controller.WizController, *utils.MemoryTransport) {
+	t.Helper()
+
+	transport := utils.NewMemoryTransport()
+	transport.Handle(ADDRESS, bulb.Handle)
+
+	wiz := controller.NewWizController(transport, ADDRESS)
+	wiz.Timeout = time.Second
+	wiz.Backoff = time.Millisecond
+	wiz.Debounce = 5 * time.Millisecond
+	err := wiz.Init(context.Background())
+	if err != nil || wiz.Mac() != bulb.Mac {
+		wiz.Stop()
+		t.Fatalf("controller did not initialize from the simulated bulb: mac is %q (%v)", wiz.Mac(), err)
+	}
+	return wiz, transport
+}
+
+// Run with -race: HomeKit calls hooks concurrently, while polling and heartbeats update the state in the background
+func TestConcurrentUse(t *testing.T) {
+	bulb := simulator.NewBulb("")
+	wiz, _ := simulated(t, bulb)
+	wiz.PollInterval = 10 * time.Millisecond
+	wiz.MaxStaleness = 20 * time.Millisecond
+	wiz.Observe(func(state controller.State) {}, func(err error) {})
+	wiz.Poll()
+
+	group := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < 20; j++ {
+				wiz.SetHue(float64((i*20 + j) % 360))
+				wiz.SetSaturation(float64(j % 100))
+				wiz.SetBrightness(10 + j%90)
+				wiz.SetOn(j%2 == 0)
+				wiz.GetOn()
+				wiz.GetHue()
+				wiz.GetSaturation()
+				wiz.GetBrightness()
+				wiz.GetColorTemperature()
+				wiz.Sync(bulb.State())
+				if j%10 == 0 {
+					_ = wiz.Read(context.Background())
+				}
+			}
+		}(i)
+	}
+	group.Wait()
+
+	// The last change wins, and is written by Stop at the latest
+	wiz.SetOn(true)
+	wiz.SetBrightness(42)
+	wiz.Stop()
+
+	state := bulb.State()
+	if !state.On || state.Dimming != 42 {
+		t.Errorf("last change was not written: bulb is on=%t dimming=%d, expected on=true dimming=42", state.On, state.Dimming)
+	}
+	if err := wiz.Read(context.Background()); err != controller.ErrStopped {
+		t.Errorf("expected ErrStopped once stopped, got %v", err)
+	}
+}
+
+// Answer messages the way a bulb would, with the method and id of the request echoed back
+func answer(body string) func(message string) string {
+	return func(message string) string {
+		request := struct {
+			Method string `json:"method"`
+			Id     uint   `json:"id"`
+		}{}
+		_ = json.Unmarshal([]byte(message), &request)
+		return fmt.Sprintf(`{"method":%q,"id":%d,"env":"pro",%s}`, request.Method, request.Id, body)
+	}
+}
+
+func TestRead(t *testing.T) {
+	bulb := simulator.NewBulb("")
+	wiz, _ := simulated(t, bulb)
+	defer wiz.Stop()
+
+	changes := make(chan controller.State, 1)
+	wiz.Observe(func(state controller.State) {
+		changes <- state
+	}, nil)
+
+	bulb.Handle(`{"method":"setPilot","params":{"r":12,"g":34,"b":56,"dimming":70}}`)
+	err := wiz.Read(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wiz.Snapshot() != bulb.State() {
+		t.Errorf("expected state %+v, got %+v", bulb.State(), wiz.Snapshot())
+	}
+	select {
+	case state := <-changes:
+		if state != bulb.State() {
+			t.Errorf("OnChange got %+v, expected %+v", state, bulb.State())
+		}
+	default:
+		t.Errorf("OnChange was not called for a state changed outside of the controller")
+	}
+}
+
+func TestReadFirmwareInfo(t *testing.T) {
+	bulb := simulator.NewBulb("a8bb50000042")
+	bulb.ModuleName = "ESP06_SHDW9_01"
+	bulb.FwVersion = "1.22.0"
+	wiz, _ := simulated(t, bulb)
+	defer wiz.Stop()
+
+	err := wiz.ReadFirmwareInfo(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	firmware := wiz.Firmware()
+	if firmware.Mac != bulb.Mac || firmware.ModuleName != bulb.ModuleName || firmware.FwVersion != bulb.FwVersion {
+		t.Errorf("expected %s %s %s, got %s %s %s", bulb.Mac, bulb.ModuleName, bulb.FwVersion, firmware.Mac, firmware.ModuleName, firmware.FwVersion)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	bulb := simulator.NewBulb("")
+	wiz, _ := simulated(t, bulb)
+	defer wiz.Stop()
+	// Write every change right away
+	wiz.Debounce = 0
+
+	wiz.SetOn(false)
+	wiz.SetColorTemperature(250)
+	wiz.SetBrightness(30)
+	state := bulb.State()
+	if state.On || state.Temp != 4000 || state.Dimming != 30 {
+		t.Errorf("bulb did not get the change: %+v", state)
+	}
+
+	// Write sends the state as is, whatever the bulb did in the meantime
+	bulb.Handle(`{"method":"setPilot","params":{"state":true,"dimming":90}}`)
+	err := wiz.Write(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state = bulb.State()
+	if state.On || state.Dimming != 30 {
+		t.Errorf("bulb did not get the state back: %+v", state)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	operations := []struct {
+		name string
+		run  func(wiz *controller.WizController) error
+	}{
+		{"Read", func(wiz *controller.WizController) error { return wiz.Read(context.Background()) }},
+		{"Write", func(wiz *controller.WizController) error { return wiz.Write(context.Background()) }},
+		{"ReadFirmwareInfo", func(wiz *controller.WizController) error { return wiz.ReadFirmwareInfo(context.Background()) }},
+	}
+	failures := []struct {
+		name     string
+		handler  func(message string) string
+		expected error
+	}{
+		{"timeout", func(message string) string { return "" }, controller.ErrTimeout},
+		{"rejected", answer(`"error":{"code":-32000,"message":"nope"}`), controller.ErrBulbRejected},
+		{"malformed", func(message string) string { return `{"method":` }, controller.ErrMalformedResponse},
+		{"malformed result", answer(`"result":"nope"`), controller.ErrMalformedResponse},
+	}
+
+	for _, operation := range operations {
+		for _, failure := range failures {
+			t.Run(operation.name+"/"+failure.name, func(t *testing.T) {
+				wiz, transport := simulated(t, simulator.NewBulb(""))
+				defer wiz.Stop()
+				wiz.Retries = 2
+
+				transport.Handle(ADDRESS, failure.handler)
+				err := operation.run(wiz)
+				if !errors.Is(err, failure.expected) {
+					t.Fatalf("expected %v, got %v", failure.expected, err)
+				}
+				bulbErr := &controller.BulbError{}
+				if errors.As(err, &bulbErr) && (bulbErr.Code != -32000 || bulbErr.Message != "nope") {
+					t.Errorf("bulb error did not carry what the bulb answered: %+v", bulbErr)
+				}
+			})
+		}
+	}
+
+	// Bulbs answer setPilot with a success flag
+	t.Run("Write/no success", func(t *testing.T) {
+		wiz, transport := simulated(t, simulator.NewBulb(""))
+		defer wiz.Stop()
+
+		transport.Handle(ADDRESS, answer(`"result":{"success":false}`))
+		err := wiz.Write(context.Background())
+		if !errors.Is(err, controller.ErrBulbRejected) {
+			t.Fatalf("expected %v, got %v", controller.ErrBulbRejected, err)
+		}
+	})
+}
+
+// A late answer to a message we gave up on must not be taken for the answer to the next one
+func TestMismatchedId(t *testing.T) {
+	bulb := simulator.NewBulb("")
+	wiz, transport := simulated(t, bulb)
+	defer wiz.Stop()
+	wiz.Retries = 2
+
+	sent := 0
+	transport.Handle(ADDRESS, func(message string) string {
+		sent++
+		response := bulb.Handle(message)
+		if sent > 1 {
+			return response
+		}
+		// Same method, other id, other state
+		stale := map[string]interface{}{}
+		_ = json.Unmarshal([]byte(response), &stale)
+		stale["id"] = stale["id"].(float64) + 1000
+		stale["result"].(map[string]interface{})["dimming"] = 1
+		j, _ := json.Marshal(stale)
+		return string(j)
+	})
+
+	err := wiz.Read(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent != 2 {
+		t.Errorf("expected the message to be sent again after the stale answer, sent %d times", sent)
+	}
+	if wiz.Snapshot().Dimming != bulb.State().Dimming {
+		t.Errorf("the stale answer was taken: dimming is %d, expected %d", wiz.Snapshot().Dimming, bulb.State().Dimming)
+	}
+}
+
+// What goes out with setPilot depends on the device, on the mode, and on how colors are mixed
+func TestSetPilotPayload(t *testing.T) {
+	cases := []struct {
+		name     string
+		module   string
+		change   func(wiz *controller.WizController) error
+		expected string
+	}{
+		{"color", simulator.DEFAULT_MODULE, func(wiz *controller.WizController) error {
+			wiz.SetHue(120)
+			wiz.SetSaturation(100)
+			return nil
+		}, `{"state":true,"r":0,"g":255,"b":0,"c":0,"w":0,"dimming":100}`},
+		{"pastel", simulator.DEFAULT_MODULE, func(wiz *controller.WizController) error {
+			wiz.SetHue(30)
+			wiz.SetSaturation(50)
+			return nil
+		}, `{"state":true,"r":127,"g":63,"b":0,"c":128,"w":128,"dimming":100}`},
+		{"white", simulator.DEFAULT_MODULE, func(wiz *controller.WizController) error {
+			wiz.SetColorTemperature(200)
+			return nil
+		}, `{"state":true,"temp":5000,"dimming":100}`},
+		{"scene", simulator.DEFAULT_MODULE, func(wiz *controller.WizController) error {
+			return wiz.SetScene(context.Background(), controller.SceneFireplace, 50)
+		}, `{"state":true,"sceneId":5,"speed":50,"dimming":100}`},
+		{"scene at default speed", simulator.DEFAULT_MODULE, func(wiz *controller.WizController) error {
+			return wiz.SetScene(context.Background(), controller.SceneFireplace, 0)
+		}, `{"state":true,"sceneId":5,"dimming":100}`},
+		{"tunable white", "ESP05_SHTW_21", func(wiz *controller.WizController) error {
+			wiz.SetColorTemperature(250)
+			wiz.SetBrightness(40)
+			return nil
+		}, `{"state":true,"temp":4000,"dimming":40}`},
+		{"dimmable white", "ESP06_SHDW9_01", func(wiz *controller.WizController) error {
+			wiz.SetColorTemperature(250)
+			wiz.SetBrightness(40)
+			return nil
+		}, `{"state":true,"dimming":40}`},
+		{"plug", "ESP10_SOCKET_06", func(wiz *controller.WizController) error {
+			wiz.SetBrightness(40)
+			wiz.SetOn(false)
+			return nil
+		}, `{"state":false}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bulb := simulator.NewBulb("")
+			bulb.ModuleName = c.module
+			wiz, transport := simulated(t, bulb)
+			defer wiz.Stop()
+			// Write every change right away
+			wiz.Debounce = 0
+
+			var params json.RawMessage
+			transport.Handle(ADDRESS, func(message string) string {
+				request := struct {
+					Method string          `json:"method"`
+					Params json.RawMessage `json:"params"`
+				}{}
+				_ = json.Unmarshal([]byte(message), &request)
+				if request.Method == controller.METHOD_SET_PILOT {
+					params = request.Params
+				}
+				return bulb.Handle(message)
+			})
+
+			err := c.change(wiz)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := map[string]interface{}{}
+			expected := map[string]interface{}{}
+			_ = json.Unmarshal(params, &got)
+			_ = json.Unmarshal([]byte(c.expected), &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected %s, got %s", c.expected, params)
+			}
+		})
+	}
+}
+
+// HomeKit must get back the very hue and saturation it set, once the bulb echoes the channels back (read, or pushed)
+func TestColorRoundTrip(t *testing.T) {
+	for _, mixing := range []controller.Mixing{controller.MIXING_RGB, controller.MIXING_RGBW, controller.MIXING_RGBCW} {
+		t.Run(string(mixing), func(t *testing.T) {
+			bulb := simulator.NewBulb("")
+			wiz, _ := simulated(t, bulb)
+			defer wiz.Stop()
+			wiz.Mixing = mixing
+			// Write every change right away
+			wiz.Debounce = 0
+
+			// HomeKit steps are a degree and a percent
+			roundTrip := func(h uint16, s uint8) bool {
+				hue := float64(h % 360)
+				saturation := float64(s % 101)
+				wiz.SetHue(hue)
+				wiz.SetSaturation(saturation)
+
+				err := wiz.Read(context.Background())
+				if err != nil {
+					t.Logf("unexpected error: %v", err)
+					return false
+				}
+				if wiz.Hue() != hue || wiz.Saturation() != saturation {
+					t.Logf("set %v,%v, read back %v,%v", hue, saturation, wiz.Hue(), wiz.Saturation())
+					return false
+				}
+
+				wiz.Sync(bulb.State())
+				if wiz.Hue() != hue || wiz.Saturation() != saturation {
+					t.Logf("set %v,%v, pushed back %v,%v", hue, saturation, wiz.Hue(), wiz.Saturation())
+					return false
+				}
+				return true
+			}
+			err := quick.Check(roundTrip, &quick.Config{MaxCount: 500})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
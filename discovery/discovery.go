@@ -0,0 +1,92 @@
+// Package discovery finds Wiz bulbs on the local network by broadcasting to them
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"github.com/dubo-dubon-duponey/wizhard/utils"
+	"net"
+	"sort"
+	"time"
+)
+
+// Default address to broadcast to
+const DEFAULT_BROADCAST = "255.255.255.255"
+
+// Port Wiz bulbs are listening on
+const PORT = 38899
+
+// Default time to wait for bulbs to answer
+const DEFAULT_WINDOW = 3 * time.Second
+
+// Bulb is a Wiz bulb that answered our broadcast
+type Bulb struct {
+	Mac      string              `json:"mac"`
+	IP       string              `json:"ip"`
+	Firmware controller.Firmware `json:"firmware"`
+}
+
+// Address of the bulb, ready to be used with a controller
+func (b Bulb) Address() string {
+	return net.JoinHostPort(b.IP, fmt.Sprint(PORT))
+}
+
+// Discover broadcasts getSystemConfig and returns every bulb that answered within window, sorted by ip
+func Discover(broadcast string, window time.Duration) ([]Bulb, error) {
+	if broadcast == "" {
+		broadcast = DEFAULT_BROADCAST
+	}
+
+	message := controller.QueryMessage{
+		Method: controller.METHOD_GET_SYSTEM_CONFIG,
+	}
+
+	j, _ := json.Marshal(message)
+
+	responses, err := utils.UDPBroadcast(net.JoinHostPort(broadcast, fmt.Sprint(PORT)), bytes.NewReader(j), window)
+	if err != nil {
+		return nil, err
+	}
+
+	// A bulb may answer more than once, and from more than one address if it just changed
+	byMac := map[string]Bulb{}
+	for _, response := range responses {
+		data := controller.ResponseSystem{}
+		err = json.Unmarshal([]byte(response.Message), &data)
+		if err != nil || data.Method != controller.METHOD_GET_SYSTEM_CONFIG || data.Result.Mac == "" {
+			fmt.Println("Ignoring unexpected response from", response.Address, response.Message)
+			continue
+		}
+		byMac[data.Result.Mac] = Bulb{
+			Mac:      data.Result.Mac,
+			IP:       response.Address.IP.String(),
+			Firmware: data.Result,
+		}
+	}
+
+	bulbs := []Bulb{}
+	for _, bulb := range byMac {
+		bulbs = append(bulbs, bulb)
+	}
+	sort.Slice(bulbs, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(bulbs[i].IP).To16(), net.ParseIP(bulbs[j].IP).To16()) < 0
+	})
+
+	return bulbs, nil
+}
+
+// Find looks for the bulb with that mac address on the network
+func Find(broadcast string, mac string, window time.Duration) (Bulb, error) {
+	bulbs, err := Discover(broadcast, window)
+	if err != nil {
+		return Bulb{}, err
+	}
+	for _, bulb := range bulbs {
+		if bulb.Mac == mac {
+			return bulb, nil
+		}
+	}
+	return Bulb{}, fmt.Errorf("bulb %s did not answer", mac)
+}
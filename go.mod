@@ -4,6 +4,7 @@ require (
 	github.com/brutella/hc v1.2.2
 	github.com/lucasb-eyer/go-colorful v1.0.3
 	github.com/urfave/cli v1.22.4
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 // replace github.com/go-xorm/core => xorm.io/core v0.6.3
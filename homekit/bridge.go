@@ -0,0 +1,149 @@
+package homekit
+
+import (
+	"fmt"
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"strings"
+	"sync"
+)
+
+// Bridge exposes a changing set of Wiz accessories over HomeKit
+// hc does not support adding accessories to a running transport, so changes to the set restart the transport
+// (with the same storage, so pairing is kept, and HomeKit is told about the new configuration)
+// hc also hooks into every characteristic of the accessories it serves and never lets go, so each transport gets
+// accessories of its own, built afresh - reusing them would pile up callbacks into dead transports on every restart
+type Bridge struct {
+	Info   accessory.Info
+	Config hc.Config
+
+	// Build the accessory for each key
+	accessories map[string]func() *accessory.Accessory
+	order       []string
+	transport   hc.Transport
+	stopping    bool
+	mutex       sync.Mutex
+}
+
+func NewBridge(info accessory.Info, config hc.Config) *Bridge {
+	return &Bridge{
+		Info:        info,
+		Config:      config,
+		accessories: map[string]func() *accessory.Accessory{},
+	}
+}
+
+// Add an accessory to the bridge under the given key, returning false if there is already one under that key
+// build is called every time the transport (re)starts, and should return a new accessory each time
+// Changes are only seen by HomeKit after a call to Refresh
+func (b *Bridge) Add(key string, build func() *accessory.Accessory) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.accessories[key]; ok {
+		return false
+	}
+	b.accessories[key] = build
+	b.order = append(b.order, key)
+	return true
+}
+
+// Remove the accessory under the given key, returning false if there is none
+// Changes are only seen by HomeKit after a call to Refresh
+func (b *Bridge) Remove(key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.accessories[key]; !ok {
+		return false
+	}
+	delete(b.accessories, key)
+	for i, k := range b.order {
+		if k == key {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Has returns whether there is an accessory under that key
+func (b *Bridge) Has(key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, ok := b.accessories[key]
+	return ok
+}
+
+// Run exposes the bridge over HomeKit, blocking until Stop is called
+func (b *Bridge) Run() error {
+	for {
+		b.mutex.Lock()
+		if b.stopping {
+			b.mutex.Unlock()
+			return nil
+		}
+		accessories := []*accessory.Accessory{}
+		for _, key := range b.order {
+			accessories = append(accessories, b.accessories[key]())
+		}
+		t, err := hc.NewIPTransport(b.Config, accessory.NewBridge(b.Info).Accessory, accessories...)
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		b.transport = t
+		b.mutex.Unlock()
+
+		fmt.Println("Exposing", len(accessories), "accessories:", strings.Join(b.order, ", "))
+		// Blocks until the transport is stopped
+		t.Start()
+	}
+}
+
+// Refresh restarts the transport so that HomeKit picks up added (or removed) accessories
+// hc notices the accessories changed, and bumps the configuration number so that controllers fetch them again
+func (b *Bridge) Refresh() {
+	b.mutex.Lock()
+	t := b.transport
+	b.transport = nil
+	b.mutex.Unlock()
+
+	// Not running yet (or already restarting) - the next transport will have the new accessories anyhow
+	if t != nil {
+		<-t.Stop()
+	}
+}
+
+// Stop the bridge, making Run return
+func (b *Bridge) Stop() {
+	b.mutex.Lock()
+	b.stopping = true
+	t := b.transport
+	b.transport = nil
+	b.mutex.Unlock()
+
+	if t != nil {
+		<-t.Stop()
+	}
+}
+
+// IDFromMac derives a stable HomeKit accessory id from a bulb mac address
+// The bridge itself uses 1, and mac addresses are 48 bits, so this never collides
+func IDFromMac(mac string) uint64 {
+	var id uint64
+	for _, c := range strings.ToLower(mac) {
+		switch {
+		case c >= '0' && c <= '9':
+			id = id<<4 | uint64(c-'0')
+		case c >= 'a' && c <= 'f':
+			id = id<<4 | uint64(c-'a'+10)
+		}
+	}
+	// Should never happen with a real mac address, but 0 means "pick one for me" and 1 is the bridge
+	if id < 2 {
+		id += 2
+	}
+	return id
+}
@@ -1,7 +1,9 @@
 package homekit
 
 import (
+	"fmt"
 	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
 	"github.com/dubo-dubon-duponey/wizhard/controller"
 )
@@ -9,32 +11,134 @@ import (
 type WizLightbulb struct {
 	*accessory.Accessory
 
-	Lightbulb *service.ColoredLightbulb
+	// Only the characteristics the bulb supports are there (see controller.Capabilities) - the others are nil
+	Lightbulb        *service.Lightbulb
+	Brightness       *characteristic.Brightness
+	Hue              *characteristic.Hue
+	Saturation       *characteristic.Saturation
+	ColorTemperature *characteristic.ColorTemperature
+
+	// Reports whether we can talk to the bulb
+	StatusFault *characteristic.StatusFault
+
+	// One switch per exposed scene, turning it on plays the scene on the bulb
+	Scenes map[controller.Scene]*service.Switch
 
 	Controller *controller.WizController
 }
 
-func NewWizLightbulb(address string, info accessory.Info) *WizLightbulb {
+func NewWizLightbulb(wiz *controller.WizController, info accessory.Info, scenes ...controller.Scene) *WizLightbulb {
 	acc := WizLightbulb{}
 	acc.Accessory = accessory.New(info, accessory.TypeLightbulb)
 
-	acc.Lightbulb = service.NewColoredLightbulb()
+	acc.Lightbulb = service.NewLightbulb()
 
-	acc.Controller = controller.NewWizController(address)
+	acc.Controller = wiz
+	caps := acc.Controller.Capabilities()
 
 	acc.Lightbulb.On.OnValueRemoteUpdate(acc.Controller.SetOn)
 	acc.Lightbulb.On.OnValueRemoteGet(acc.Controller.GetOn)
 
-	acc.Lightbulb.Brightness.OnValueRemoteUpdate(acc.Controller.SetBrightness)
-	acc.Lightbulb.Brightness.OnValueRemoteGet(acc.Controller.GetBrightness)
+	if caps.Dimmable {
+		acc.Brightness = characteristic.NewBrightness()
+		acc.Lightbulb.AddCharacteristic(acc.Brightness.Characteristic)
+
+		acc.Brightness.OnValueRemoteUpdate(acc.Controller.SetBrightness)
+		acc.Brightness.OnValueRemoteGet(acc.Controller.GetBrightness)
+	}
+
+	if caps.Color {
+		acc.Hue = characteristic.NewHue()
+		acc.Lightbulb.AddCharacteristic(acc.Hue.Characteristic)
+
+		acc.Hue.OnValueRemoteUpdate(acc.Controller.SetHue)
+		acc.Hue.OnValueRemoteGet(acc.Controller.GetHue)
 
-	acc.Lightbulb.Hue.OnValueRemoteUpdate(acc.Controller.SetHue)
-	acc.Lightbulb.Hue.OnValueRemoteGet(acc.Controller.GetHue)
+		acc.Saturation = characteristic.NewSaturation()
+		acc.Lightbulb.AddCharacteristic(acc.Saturation.Characteristic)
 
-	acc.Lightbulb.Saturation.OnValueRemoteUpdate(acc.Controller.SetSaturation)
-	acc.Lightbulb.Saturation.OnValueRemoteGet(acc.Controller.GetSaturation)
+		acc.Saturation.OnValueRemoteUpdate(acc.Controller.SetSaturation)
+		acc.Saturation.OnValueRemoteGet(acc.Controller.GetSaturation)
+	}
+
+	// Restricted to the white range the bulb supports
+	if caps.TunableWhite {
+		acc.ColorTemperature = characteristic.NewColorTemperature()
+		acc.ColorTemperature.SetMinValue(controller.KelvinToMired(caps.KelvinMax))
+		acc.ColorTemperature.SetMaxValue(controller.KelvinToMired(caps.KelvinMin))
+		acc.ColorTemperature.SetValue(controller.KelvinToMired(caps.KelvinMin))
+		acc.Lightbulb.AddCharacteristic(acc.ColorTemperature.Characteristic)
+
+		acc.ColorTemperature.OnValueRemoteUpdate(acc.Controller.SetColorTemperature)
+		acc.ColorTemperature.OnValueRemoteGet(acc.Controller.GetColorTemperature)
+	}
 
 	acc.AddService(acc.Lightbulb.Service)
 
+	acc.Scenes = map[controller.Scene]*service.Switch{}
+	for _, scene := range scenes {
+		acc.addScene(scene)
+	}
+
+	// Last, as changes start flowing in right away
+	acc.StatusFault = observe(acc.Controller, acc.Lightbulb.Service, acc.sync)
+
 	return &acc
 }
+
+// Push the bulb state, as last known by the controller, to HomeKit
+func (acc *WizLightbulb) sync() {
+	acc.Lightbulb.On.SetValue(acc.Controller.On())
+	if acc.Brightness != nil {
+		acc.Brightness.SetValue(acc.Controller.Brightness())
+	}
+	if acc.Hue != nil {
+		acc.Hue.SetValue(acc.Controller.Hue())
+		acc.Saturation.SetValue(acc.Controller.Saturation())
+	}
+	if acc.ColorTemperature != nil {
+		acc.ColorTemperature.SetValue(acc.Controller.ColorTemperature())
+	}
+	acc.syncScenes()
+}
+
+// Expose a scene as a switch - the switch is on as long as the bulb is playing that scene
+func (acc *WizLightbulb) addScene(scene controller.Scene) {
+	if _, ok := acc.Scenes[scene]; ok {
+		return
+	}
+
+	sw := service.NewSwitch()
+	name := characteristic.NewName()
+	name.SetValue(scene.String())
+	sw.AddCharacteristic(name.Characteristic)
+
+	sw.On.OnValueRemoteGet(func() bool {
+		return acc.Controller.GetScene() == scene
+	})
+
+	sw.On.OnValueRemoteUpdate(func(value bool) {
+		var err error
+		if value {
+			err = acc.Controller.SetScene(acc.Controller.Context(), scene, 0)
+		} else if acc.Controller.Scene() == scene {
+			err = acc.Controller.ClearScene(acc.Controller.Context())
+		}
+		if err != nil {
+			fmt.Println("Alas, we could not change the scene on thy noble lightbulb", err)
+		}
+		report(acc.StatusFault, err)
+		acc.syncScenes()
+	})
+
+	acc.Scenes[scene] = sw
+	acc.AddService(sw.Service)
+}
+
+// Reflect the scene currently played by the bulb on all scene switches
+func (acc *WizLightbulb) syncScenes() {
+	current := acc.Controller.Scene()
+	for scene, sw := range acc.Scenes {
+		sw.On.SetValue(scene == current)
+	}
+}
@@ -0,0 +1,47 @@
+package homekit
+
+import (
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+)
+
+// WizOutlet is a Wiz plug - same protocol as the bulbs, but it only knows about on and off
+type WizOutlet struct {
+	*accessory.Accessory
+
+	Outlet *service.Outlet
+
+	// Reports whether we can talk to the plug
+	StatusFault *characteristic.StatusFault
+
+	Controller *controller.WizController
+}
+
+func NewWizOutlet(wiz *controller.WizController, info accessory.Info) *WizOutlet {
+	acc := WizOutlet{}
+	acc.Accessory = accessory.New(info, accessory.TypeOutlet)
+
+	acc.Outlet = service.NewOutlet()
+
+	acc.Controller = wiz
+
+	acc.Outlet.On.OnValueRemoteUpdate(acc.Controller.SetOn)
+	acc.Outlet.On.OnValueRemoteGet(acc.Controller.GetOn)
+
+	// Plugs do not report whether something draws power from them: a plug that is on is as much in use as we can tell
+	acc.Outlet.OutletInUse.OnValueRemoteGet(acc.Controller.GetOn)
+
+	acc.AddService(acc.Outlet.Service)
+
+	acc.StatusFault = observe(acc.Controller, acc.Outlet.Service, acc.sync)
+
+	return &acc
+}
+
+// Push the plug state, as last known by the controller, to HomeKit
+func (acc *WizOutlet) sync() {
+	acc.Outlet.On.SetValue(acc.Controller.On())
+	acc.Outlet.OutletInUse.SetValue(acc.Controller.On())
+}
@@ -0,0 +1,153 @@
+package homekit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Name of the file (in the data path) where the registry is persisted
+const REGISTRY_FILE = "wizhard-bulbs.json"
+
+// Identity is what HomeKit knows a bulb by - it must not change once the bulb has been exposed
+type Identity struct {
+	// HomeKit accessory id
+	ID uint64 `json:"id"`
+	// Name the bulb was first exposed with
+	Name string `json:"name"`
+	// Serial number the bulb was first exposed with
+	SerialNumber string `json:"serial"`
+	// Last address the bulb was seen at
+	Address string `json:"address"`
+}
+
+// Registry persists the identity of the bulbs we expose, keyed by mac address, so that they survive ip changes and restarts
+// Bulbs that never answered are keyed by address until they do
+type Registry struct {
+	path  string
+	Bulbs map[string]*Identity `json:"bulbs"`
+	mutex sync.Mutex
+}
+
+// LoadRegistry reads the registry from the data path, starting a new one if there is none yet
+func LoadRegistry(storagePath string) (*Registry, error) {
+	r := &Registry{
+		path:  filepath.Join(storagePath, REGISTRY_FILE),
+		Bulbs: map[string]*Identity{},
+	}
+
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted registry %s: %v", r.path, err)
+	}
+	return r, nil
+}
+
+// Identity returns the identity for the bulb with that mac (last seen at address), creating and persisting it if it is new
+// If the mac is unknown (bulb not answering), we fallback to whatever bulb was last seen at that address - bulbs we
+// never heard from get an identity of their own, stored under their address, which they keep once they answer
+func (r *Registry) Identity(mac string, address string) (*Identity, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := mac
+	if key == "" {
+		for k, identity := range r.Bulbs {
+			if identity.Address == address {
+				fmt.Println("Bulb at", address, "is not answering, assuming it is", k)
+				return identity, nil
+			}
+		}
+		// Never seen that one - reserve its name, so that no other bulb gets it
+		fmt.Println("Bulb at", address, "is not answering and has never been seen before")
+		identity := &Identity{
+			ID:           idFromAddress(address),
+			Name:         r.name(),
+			SerialNumber: address,
+			Address:      address,
+		}
+		r.Bulbs[address] = identity
+		return identity, r.save()
+	}
+
+	identity, ok := r.Bulbs[key]
+	if !ok {
+		// A bulb that did not answer before
+		if identity, ok = r.Bulbs[address]; ok {
+			fmt.Println("Bulb at", address, "finally answered, it is", mac)
+			delete(r.Bulbs, address)
+			r.Bulbs[key] = identity
+			return identity, r.save()
+		}
+		identity = &Identity{
+			ID:           IDFromMac(mac),
+			Name:         r.name(),
+			SerialNumber: mac,
+		}
+		r.Bulbs[key] = identity
+	}
+	if identity.Address == address && ok {
+		return identity, nil
+	}
+	if ok {
+		fmt.Println("Bulb", mac, "moved from", identity.Address, "to", address)
+	}
+	identity.Address = address
+	return identity, r.save()
+}
+
+// First name not taken yet - mutex must be held
+func (r *Registry) name() string {
+	taken := map[string]bool{}
+	for _, identity := range r.Bulbs {
+		taken[identity.Name] = true
+	}
+	for n := len(r.Bulbs) + 1; ; n++ {
+		if name := fmt.Sprintf("Wiz %d", n); !taken[name] {
+			return name
+		}
+	}
+}
+
+func (r *Registry) save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, data, 0644)
+}
+
+// Accessory id for a bulb we only know the address of
+func idFromAddress(address string) uint64 {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	var id uint64
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		for _, b := range ip {
+			id = id<<8 | uint64(b)
+		}
+	}
+	// Same as mac derived ids, 0 and 1 are off limits
+	if id < 2 {
+		id += 2
+	}
+	return id
+}
@@ -0,0 +1,32 @@
+package homekit
+
+import (
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+)
+
+// Hook a Wiz accessory to its controller: sync is called whenever the device changes from elsewhere (Wiz app, physical
+// switch), and failures talking to it are reported on a status fault added to the main service
+// hc gives us no way to answer a write with a "service communication failure" status, so failures are reported
+// as a fault on the service instead, and the characteristics get back in sync on the next successful read
+func observe(wiz *controller.WizController, main *service.Service, sync func()) *characteristic.StatusFault {
+	fault := characteristic.NewStatusFault()
+	main.AddCharacteristic(fault.Characteristic)
+
+	wiz.Observe(func(state controller.State) {
+		sync()
+	}, func(err error) {
+		report(fault, err)
+	})
+	return fault
+}
+
+// Report whether the last exchange with the device failed
+func report(fault *characteristic.StatusFault, err error) {
+	if err != nil {
+		fault.SetValue(characteristic.StatusFaultGeneralFault)
+		return
+	}
+	fault.SetValue(characteristic.StatusFaultNoFault)
+}
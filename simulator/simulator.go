@@ -0,0 +1,348 @@
+// Package simulator pretends to be a Wiz bulb, so that the bridge can be exercised without any actual bulb around
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dubo-dubon-duponey/wizhard/controller"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mac address used by default
+const DEFAULT_MAC = "a8bb50000001"
+
+// Module name used by default - a full color bulb
+const DEFAULT_MODULE = "ESP01_SHRGB1C_31"
+
+// Firmware version used by default
+const DEFAULT_FIRMWARE = "1.21.0"
+
+// How often heartbeats are pushed to whoever registered, by default
+const SYNC_INTERVAL = 5 * time.Second
+
+// Error codes answered by the bulbs, JSON-RPC style
+const ERROR_INVALID_REQUEST = -32600
+const ERROR_METHOD_NOT_FOUND = -32601
+const ERROR_INVALID_PARAMS = -32602
+
+// Error code answered when an error is injected (see ErrorRate)
+const ERROR_INJECTED = -32000
+
+// Bulb is a simulated Wiz bulb
+// It answers messages either from a socket (see Listen), or directly (see Handle, eg: with utils.MemoryTransport)
+type Bulb struct {
+	// System info answered to getSystemConfig
+	Mac        string
+	ModuleName string
+	FwVersion  string
+
+	// How long to wait before answering
+	Latency time.Duration
+	// Probability (0 to 1) for a message to get lost, unanswered
+	Loss float64
+	// Probability (0 to 1) for a message to be answered with an error
+	ErrorRate float64
+
+	// How often heartbeats are pushed to whoever registered
+	SyncInterval time.Duration
+	// Port heartbeats are pushed to
+	SyncPort int
+
+	mutex      sync.Mutex
+	state      controller.State
+	registered map[string]bool
+	conn       *net.UDPConn
+	closed     chan struct{}
+}
+
+func NewBulb(mac string) *Bulb {
+	if mac == "" {
+		mac = DEFAULT_MAC
+	}
+	return &Bulb{
+		Mac:          mac,
+		ModuleName:   DEFAULT_MODULE,
+		FwVersion:    DEFAULT_FIRMWARE,
+		SyncInterval: SYNC_INTERVAL,
+		SyncPort:     controller.LISTENER_PORT,
+		state: controller.State{
+			On:      true,
+			Temp:    controller.KELVIN_DEFAULT,
+			Dimming: 100,
+		},
+		registered: map[string]bool{},
+		closed:     make(chan struct{}),
+	}
+}
+
+// State of the bulb, as it would answer to getPilot
+func (b *Bulb) State() controller.State {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.pilot()
+}
+
+// Listen answers messages received on address (eg: "127.0.0.1:38899"), and pushes heartbeats, until Close is called
+func (b *Bulb) Listen(address string) error {
+	laddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.conn = conn
+	b.mutex.Unlock()
+
+	fmt.Println("Simulated bulb", b.Mac, "listening on", conn.LocalAddr())
+
+	go b.heartbeat()
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			nRead, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				fmt.Println("Simulated bulb", b.Mac, "stopped listening", err)
+				return
+			}
+
+			// Like actual bulbs, one message at a time
+			response := b.Handle(string(buffer[0:nRead]))
+			if response == "" {
+				continue
+			}
+			_, err = conn.WriteToUDP([]byte(response), addr)
+			if err != nil {
+				fmt.Println("Simulated bulb", b.Mac, "failed answering", addr, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops listening and pushing heartbeats
+func (b *Bulb) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+		return nil
+	default:
+	}
+	close(b.closed)
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+// Handle processes a single message, and returns the response - empty if the message got lost (see Loss)
+func (b *Bulb) Handle(message string) string {
+	if b.Latency > 0 {
+		time.Sleep(b.Latency)
+	}
+
+	if b.Loss > 0 && rand.Float64() < b.Loss {
+		fmt.Println("Simulated bulb", b.Mac, "lost", message)
+		return ""
+	}
+
+	request := struct {
+		Method string          `json:"method"`
+		Id     uint            `json:"id"`
+		Params json.RawMessage `json:"params"`
+	}{}
+	err := json.Unmarshal([]byte(message), &request)
+	if err != nil {
+		return b.failure(request.Method, request.Id, ERROR_INVALID_REQUEST, "Invalid Request")
+	}
+
+	if b.ErrorRate > 0 && rand.Float64() < b.ErrorRate {
+		return b.failure(request.Method, request.Id, ERROR_INJECTED, "Simulated error")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch request.Method {
+	case controller.METHOD_GET_PILOT:
+		return b.success(request.Method, request.Id, b.pilot())
+	case controller.METHOD_GET_SYSTEM_CONFIG:
+		return b.success(request.Method, request.Id, controller.Firmware{
+			Mac:        b.Mac,
+			HomeId:     1,
+			RoomId:     1,
+			ModuleName: b.ModuleName,
+			FwVersion:  b.FwVersion,
+		})
+	case controller.METHOD_SET_PILOT:
+		if !b.setPilot(request.Params) {
+			return b.failure(request.Method, request.Id, ERROR_INVALID_PARAMS, "Invalid params")
+		}
+		go b.sync()
+		return b.success(request.Method, request.Id, controller.Result{Success: true})
+	case controller.METHOD_REGISTRATION:
+		registration := controller.Registration{}
+		if json.Unmarshal(request.Params, &registration) != nil || net.ParseIP(registration.PhoneIp) == nil {
+			return b.failure(request.Method, request.Id, ERROR_INVALID_PARAMS, "Invalid params")
+		}
+		if registration.Register {
+			b.registered[registration.PhoneIp] = true
+		} else {
+			delete(b.registered, registration.PhoneIp)
+		}
+		return b.success(request.Method, request.Id, struct {
+			Mac     string `json:"mac"`
+			Success bool   `json:"success"`
+		}{b.Mac, true})
+	}
+
+	return b.failure(request.Method, request.Id, ERROR_METHOD_NOT_FOUND, "Method not found")
+}
+
+// Apply setPilot params the way bulbs do: a scene, a temperature or a color switches to that mode, the rest is kept
+func (b *Bulb) setPilot(raw json.RawMessage) bool {
+	params := struct {
+		On      *bool `json:"state"`
+		SceneId *uint `json:"sceneId"`
+		Speed   *uint `json:"speed"`
+		Temp    *uint `json:"temp"`
+		R       *uint `json:"r"`
+		G       *uint `json:"g"`
+		B       *uint `json:"b"`
+		C       *uint `json:"c"`
+		W       *uint `json:"w"`
+		Dimming *uint `json:"dimming"`
+	}{}
+	if json.Unmarshal(raw, &params) != nil {
+		return false
+	}
+
+	// Validate everything before changing anything
+	if params.SceneId != nil && *params.SceneId > uint(controller.SceneSteampunk) {
+		return false
+	}
+	if params.Speed != nil && (*params.Speed < controller.SPEED_MIN || *params.Speed > controller.SPEED_MAX) {
+		return false
+	}
+	if params.Temp != nil && *params.Temp != 0 && (*params.Temp < controller.KELVIN_MIN || *params.Temp > controller.KELVIN_MAX) {
+		return false
+	}
+	if params.Dimming != nil && *params.Dimming > 100 {
+		return false
+	}
+	for _, component := range []*uint{params.R, params.G, params.B, params.C, params.W} {
+		if component != nil && *component > 255 {
+			return false
+		}
+	}
+
+	s := &b.state
+	if params.On != nil {
+		s.On = *params.On
+	}
+	if params.Dimming != nil {
+		s.Dimming = *params.Dimming
+	}
+	switch {
+	case params.SceneId != nil && *params.SceneId != 0:
+		*s = controller.State{On: s.On, Dimming: s.Dimming, SceneId: *params.SceneId, Speed: 100}
+		if params.Speed != nil {
+			s.Speed = *params.Speed
+		}
+	case params.Temp != nil && *params.Temp != 0:
+		*s = controller.State{On: s.On, Dimming: s.Dimming, Temp: *params.Temp}
+	case params.R != nil || params.G != nil || params.B != nil || params.C != nil || params.W != nil:
+		color := controller.State{On: s.On, Dimming: s.Dimming}
+		for target, component := range map[*uint]*uint{&color.R: params.R, &color.G: params.G, &color.B: params.B, &color.C: params.C, &color.W: params.W} {
+			if component != nil {
+				*target = *component
+			}
+		}
+		*s = color
+	case params.Speed != nil && s.SceneId != 0:
+		s.Speed = *params.Speed
+	}
+	return true
+}
+
+// Current state, decorated the way bulbs do - mutex must be held
+func (b *Bulb) pilot() controller.State {
+	state := b.state
+	state.Mac = b.Mac
+	state.Rssi = -55
+	state.Src = "udp"
+	return state
+}
+
+func (b *Bulb) success(method string, id uint, result interface{}) string {
+	j, _ := json.Marshal(struct {
+		Method string      `json:"method"`
+		Id     uint        `json:"id,omitempty"`
+		Env    string      `json:"env"`
+		Result interface{} `json:"result"`
+	}{method, id, "pro", result})
+	return string(j)
+}
+
+func (b *Bulb) failure(method string, id uint, code int64, message string) string {
+	j, _ := json.Marshal(struct {
+		Method string           `json:"method,omitempty"`
+		Id     uint             `json:"id,omitempty"`
+		Env    string           `json:"env"`
+		Error  controller.Error `json:"error"`
+	}{method, id, "pro", controller.Error{Code: code, Message: message}})
+	return string(j)
+}
+
+// Push heartbeats every SyncInterval until closed
+func (b *Bulb) heartbeat() {
+	if b.SyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(b.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-ticker.C:
+			b.sync()
+		}
+	}
+}
+
+// Push the current state to whoever registered - only when listening on a socket
+func (b *Bulb) sync() {
+	b.mutex.Lock()
+	conn := b.conn
+	j, _ := json.Marshal(controller.SyncMessage{
+		Method: controller.METHOD_SYNC_PILOT,
+		Env:    "pro",
+		State:  b.pilot(),
+	})
+	ips := []string{}
+	for ip := range b.registered {
+		ips = append(ips, ip)
+	}
+	b.mutex.Unlock()
+
+	if conn == nil {
+		return
+	}
+	for _, ip := range ips {
+		_, err := conn.WriteToUDP(j, &net.UDPAddr{IP: net.ParseIP(ip), Port: b.SyncPort})
+		if err != nil {
+			fmt.Println("Simulated bulb", b.Mac, "failed pushing to", ip, err)
+		}
+	}
+}
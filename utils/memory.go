@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryTransport hands messages over to in-process handlers instead of the network - for tests, and running without bulbs
+// A handler returning an empty response behaves like a lost packet: the message is sent again, as told by Retry
+type MemoryTransport struct {
+	mutex    sync.Mutex
+	handlers map[string]func(message string) string
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		handlers: map[string]func(message string) string{},
+	}
+}
+
+// Handle sets the handler answering messages sent to address - nil to make address unreachable
+func (t *MemoryTransport) Handle(address string, handler func(message string) string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if handler == nil {
+		delete(t.handlers, address)
+		return
+	}
+	t.handlers[address] = handler
+}
+
+// Exchange behaves like UDPTransport.Exchange, calling the handler for address instead of going through a socket
+func (t *MemoryTransport) Exchange(ctx context.Context, address string, message []byte, retry Retry, accept func(response string) bool) (string, error) {
+	t.mutex.Lock()
+	handler := t.handlers[address]
+	t.mutex.Unlock()
+
+	if retry.Attempts < 1 {
+		retry.Attempts = 1
+	}
+
+	backoff := retry.Backoff
+	for attempt := 1; attempt <= retry.Attempts; attempt++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		fmt.Printf("memory-written: to=%s attempt=%d\n", address, attempt)
+
+		response := ""
+		if handler != nil {
+			response = handler(string(message))
+		}
+		if response != "" && (accept == nil || accept(response)) {
+			return response, nil
+		}
+
+		if attempt < retry.Attempts && backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+
+	// Nobody answered - no point in waiting for the deadline like a socket would
+	return "", context.DeadlineExceeded
+}
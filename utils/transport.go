@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by exchanges on a transport that has been closed
+var ErrClosed = errors.New("transport closed")
+
+// UDPTransport owns a single long-lived UDP socket, shared by every exchange with every peer
+// Responses are dispatched to the exchange waiting on their source address (and accepting them, see Exchange),
+// anything else (eg: heartbeats pushed by peers) goes to the handler set with Handle
+type UDPTransport struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	waiting map[string][]*waiter
+	handler func(message string, addr *net.UDPAddr)
+	closed  chan struct{}
+}
+
+// An exchange waiting for its response
+type waiter struct {
+	accept   func(response string) bool
+	response chan string
+}
+
+// NewUDPTransport binds address (eg: ":38900" - empty for any available port) and starts reading from it
+func NewUDPTransport(address string) (*UDPTransport, error) {
+	laddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Transport listening on", conn.LocalAddr())
+
+	t := &UDPTransport{
+		conn:    conn,
+		waiting: map[string][]*waiter{},
+		closed:  make(chan struct{}),
+	}
+	go t.read()
+	return t, nil
+}
+
+// Handle sets the function called with every packet that is not a response to an exchange
+// It is called from the reading goroutine, and should not block
+func (t *UDPTransport) Handle(handler func(message string, addr *net.UDPAddr)) {
+	t.mutex.Lock()
+	t.handler = handler
+	t.mutex.Unlock()
+}
+
+// Close the socket - exchanges in flight fail with ErrClosed
+func (t *UDPTransport) Close() error {
+	select {
+	case <-t.closed:
+		return nil
+	default:
+	}
+	close(t.closed)
+	return t.conn.Close()
+}
+
+// Exchange sends a message to address through the shared socket, retransmitting it with backoff until accept returns true for a response
+// Responses that are not accepted (late answers to a previous message, duplicates) are discarded
+// A nil accept takes the first response. If ctx has no deadline, DefaultTimeout applies
+func (t *UDPTransport) Exchange(ctx context.Context, address string, message []byte, retry Retry, accept func(response string) bool) (string, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return "", err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	if retry.Attempts < 1 {
+		retry.Attempts = 1
+	}
+
+	key := raddr.String()
+	w := &waiter{
+		accept: accept,
+		// Buffered, so that the reading goroutine never blocks on us
+		response: make(chan string, 1),
+	}
+	t.mutex.Lock()
+	t.waiting[key] = append(t.waiting[key], w)
+	t.mutex.Unlock()
+	defer t.forget(key, w)
+
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		n, err := t.conn.WriteToUDP(message, raddr)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Printf("packet-written: bytes=%d to=%s attempt=%d\n", n, key, attempt)
+
+		// Last attempt waits for as long as we are allowed to
+		wait := deadline
+		if attempt < retry.Attempts && backoff > 0 && time.Now().Add(backoff).Before(deadline) {
+			wait = time.Now().Add(backoff)
+			backoff *= 2
+		}
+
+		timer := time.NewTimer(time.Until(wait))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-t.closed:
+			timer.Stop()
+			return "", ErrClosed
+		case response := <-w.response:
+			timer.Stop()
+			return response, nil
+		case <-timer.C:
+			if !wait.Before(deadline) {
+				return "", context.DeadlineExceeded
+			}
+			// Time to retransmit
+		}
+	}
+}
+
+// Stop waiting for responses for w
+func (t *UDPTransport) forget(key string, w *waiter) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	waiters := t.waiting[key]
+	for i, candidate := range waiters {
+		if candidate == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(t.waiting, key)
+		return
+	}
+	t.waiting[key] = waiters
+}
+
+// Read packets until the socket is closed, dispatching them
+func (t *UDPTransport) read() {
+	buffer := make([]byte, maxBufferSize)
+	for {
+		nRead, addr, err := t.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-t.closed:
+			default:
+				fmt.Println("Transport stopped reading", err)
+			}
+			return
+		}
+
+		message := string(buffer[0:nRead])
+		fmt.Printf("packet-received: bytes=%d from=%s: %s\n", nRead, addr.String(), message)
+
+		t.mutex.Lock()
+		var w *waiter
+		for _, candidate := range t.waiting[addr.String()] {
+			if candidate.accept == nil || candidate.accept(message) {
+				w = candidate
+				break
+			}
+		}
+		handler := t.handler
+		t.mutex.Unlock()
+
+		if w != nil {
+			// Only the first response counts - duplicates caused by retransmissions are dropped
+			select {
+			case w.response <- message:
+			default:
+			}
+			continue
+		}
+
+		if handler == nil {
+			fmt.Println("Discarding unexpected packet from", addr, message)
+			continue
+		}
+		handler(message, addr)
+	}
+}
@@ -1,87 +1,96 @@
 package utils
 
 import (
-	//  "context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"time"
 )
 
 const maxBufferSize = 1024
-const timeout = time.Duration(10 * time.Second)
 
-type Result struct {
+// Used when the context passed to an exchange has no deadline
+const DefaultTimeout = time.Duration(10 * time.Second)
+
+// Retry configures how transports retransmit messages that go unanswered
+type Retry struct {
+	// Total number of times the message is sent
+	Attempts int
+	// How long to wait for an answer before the first retransmission - doubled after each one
+	Backoff time.Duration
+}
+
+// Response is a single packet received in response to a broadcast
+type Response struct {
 	Message string
-	Error   error
+	Address *net.UDPAddr
 }
 
-func UDPClient( /*ctx context.Context,*/ address string, reader io.Reader) (res string, err error) {
-	fmt.Println("Opening com with", address)
-	raddr, err := net.ResolveUDPAddr("udp", address)
+// UDPBroadcast sends a message to address (typically a broadcast address), and collects every response received within window
+func UDPBroadcast(address string, reader io.Reader, window time.Duration) (res []Response, err error) {
+	fmt.Println("Broadcasting to", address)
+	raddr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, raddr)
+	// Unconnected socket, as responses come from any address
+	conn, err := net.ListenUDP("udp4", nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer conn.Close()
 
-	doneChan := make(chan Result)
-
-	go func() {
-		n, err := io.Copy(conn, reader)
-		if err != nil {
-			doneChan <- Result{
-				"",
-				err,
-			}
-			return
-		}
+	message, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
 
-		fmt.Printf("packet-written: bytes=%d\n", n)
+	n, err := conn.WriteToUDP(message, raddr)
+	if err != nil {
+		return nil, err
+	}
 
-		buffer := make([]byte, maxBufferSize)
+	fmt.Printf("packet-written: bytes=%d\n", n)
 
-		deadline := time.Now().Add(timeout)
-		//    err = conn.SetWriteDeadline(deadline)
-		err = conn.SetReadDeadline(deadline)
-		if err != nil {
-			doneChan <- Result{
-				"",
-				err,
-			}
-			return
-		}
+	err = conn.SetReadDeadline(time.Now().Add(window))
+	if err != nil {
+		return nil, err
+	}
 
-		nRead, addr, err := conn.ReadFrom(buffer)
+	res = []Response{}
+	buffer := make([]byte, maxBufferSize)
+	for {
+		nRead, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
-			doneChan <- Result{
-				"",
-				err,
+			// Reaching the end of the window is how we are expected to leave
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return res, nil
 			}
-			return
+			return res, err
 		}
 
 		fmt.Printf("packet-received: bytes=%d from=%s: %s\n",
 			nRead, addr.String(), string(buffer[0:nRead]))
 
-		doneChan <- Result{
-			string(buffer[0:nRead]),
-			nil,
-		}
-	}()
-
-	var foo Result
-	select {
-	/*  case <-ctx.Done():
-	    fmt.Println("cancelled")
-	    err = ctx.Err()*/
-	case foo = <-doneChan:
+		res = append(res, Response{
+			Message: string(buffer[0:nRead]),
+			Address: addr,
+		})
 	}
+}
+
+// LocalIP returns the local ip used to reach address
+func LocalIP(address string) (string, error) {
+	// Nothing is actually sent, this just asks the system for a route
+	conn, err := net.Dial("udp4", address)
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close()
 
-	return foo.Message, foo.Error
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
 }